@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/cockroachdb/errors"
+	"github.com/labstack/echo/v4"
+)
+
+// defaultArticleBatchMax は POST /articles/batch で1回に作成できる記事数のデフォルト
+const defaultArticleBatchMax = 100
+
+// articleBatchMaxFromEnv は APP_ARTICLE_BATCH_MAX から1回に作成できる記事数を返す
+func articleBatchMaxFromEnv() (int, error) {
+	n, err := intFromEnv("APP_ARTICLE_BATCH_MAX", defaultArticleBatchMax)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return n, nil
+}
+
+// validateArticle は記事のタイトルと本文を検証し、不正な場合は理由を返す(正しい場合は空文字)
+func validateArticle(title, body string) string {
+	switch {
+	case title == "":
+		return "タイトルを入力してください。"
+	case body == "":
+		return "本文を入力してください。"
+	}
+	return ""
+}
+
+// articlesPerTransaction は1トランザクションで作成する記事数(0は全て)
+// 記事毎に articles の1行と、アウトボックスを使う場合はイベントの1行を作成する
+func (h *handler) articlesPerTransaction() int {
+	if h.maxRowsPerTx <= 0 {
+		return 0
+	}
+	rows := 1
+	if h.outboxRepo != nil {
+		rows++
+	}
+	return max(1, h.maxRowsPerTx/rows)
+}
+
+// handlePostArticleBatch は最大 h.articleBatchMax 件の記事をまとめて作成し、記事毎のIDかエラーを返す
+// 全ての記事を検証してから作成する(1件でも不正な記事があれば何も作成せずに422を返す)
+// 1トランザクションで変更できる行数に上限があるバックエンド(DSQL)では、上限を超えないようにトランザクションを分ける
+// 途中のトランザクションが失敗した場合は、作成済みの記事のIDと残りの記事のエラーを207で返す
+func (h *handler) handlePostArticleBatch(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := Extract(ctx).User.ID
+
+	type item struct {
+		Title string `json:"title"`
+		Body  string `json:"body"`
+	}
+	type request struct {
+		Articles []*item `json:"articles"`
+	}
+	req := &request{}
+	if err := c.Bind(req); err != nil {
+		return errors.WithStack(err)
+	}
+	if len(req.Articles) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "記事を指定してください。")
+	}
+	if len(req.Articles) > h.articleBatchMax {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("一度に作成できる記事は%d件までです。", h.articleBatchMax))
+	}
+
+	type result struct {
+		ArticleID string `json:"article_id,omitempty"`
+		Error     string `json:"error,omitempty"`
+	}
+	type response struct {
+		Results []*result `json:"results"`
+	}
+	results := make([]*result, 0, len(req.Articles))
+	invalid := false
+	for _, a := range req.Articles {
+		r := &result{}
+		if a == nil {
+			r.Error = "記事を指定してください。"
+		} else {
+			r.Error = validateArticle(a.Title, a.Body)
+		}
+		invalid = invalid || r.Error != ""
+		results = append(results, r)
+	}
+	if invalid {
+		return c.JSON(http.StatusUnprocessableEntity, &response{Results: results})
+	}
+
+	now := h.timer.Now()
+	articles := make([]*Article, 0, len(req.Articles))
+	for _, a := range req.Articles {
+		articles = append(articles, &Article{
+			ID:                 h.idGen.NewID(),
+			Title:              a.Title,
+			Body:               a.Body,
+			UserID:             userID,
+			TotalFavoriteCount: 0,
+			Version:            1,
+			CreatedAt:          now,
+			UpdatedAt:          now,
+		})
+	}
+
+	size := h.articlesPerTransaction()
+	if size <= 0 {
+		size = len(articles)
+	}
+	for start := 0; start < len(articles); start += size {
+		chunk := articles[start:min(start+size, len(articles))]
+		if err := h.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+			if err := h.articleRepo.InsertBatch(ctx, tx, chunk); err != nil {
+				return errors.WithStack(err)
+			}
+			for _, article := range chunk {
+				if err := h.writeEvent(ctx, tx, eventArticleCreated, article.ID, article); err != nil {
+					return errors.WithStack(err)
+				}
+			}
+			return nil
+		}, withTxName("post_article_batch")); err != nil {
+			if start == 0 {
+				return errors.WithStack(err)
+			}
+			// 前のトランザクションはコミット済みなので、作成できた記事を返す
+			log.Printf("記事の一括作成に失敗しました。: %+v\n", err)
+			for _, r := range results[start:] {
+				r.Error = "記事の作成に失敗しました。"
+			}
+			return c.JSON(http.StatusMultiStatus, &response{Results: results})
+		}
+		for i, article := range chunk {
+			results[start+i].ArticleID = article.ID
+		}
+	}
+
+	return c.JSON(http.StatusOK, &response{Results: results})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// articleSort は記事一覧の並び順
+type articleSort string
+
+const (
+	articleSortNewest    articleSort = "newest"    // 作成日時の新しい順(デフォルト)
+	articleSortOldest    articleSort = "oldest"    // 作成日時の古い順
+	articleSortFavorites articleSort = "favorites" // お気に入り数の多い順
+)
+
+const (
+	defaultArticleListLimit = 100
+	maxArticleListLimit     = 100
+)
+
+func parseArticleSort(s string) (articleSort, error) {
+	switch articleSort(s) {
+	case "", articleSortNewest:
+		return articleSortNewest, nil
+	case articleSortOldest, articleSortFavorites:
+		return articleSort(s), nil
+	}
+	return "", errors.Newf("未対応の並び順です。: %s", s)
+}
+
+// articleCursor は前のページの最後の記事の位置(同じ値の記事は id で並べる)
+// 並び順に使う値だけを設定する(newest, oldest は CreatedAt、favorites は FavoriteCount)
+type articleCursor struct {
+	Sort          articleSort `json:"s"`
+	CreatedAt     time.Time   `json:"t"`
+	FavoriteCount int         `json:"c,omitempty"`
+	ID            string      `json:"id"`
+}
+
+// newArticleCursor は記事の位置を返す
+func newArticleCursor(sort articleSort, article *Article) *articleCursor {
+	cursor := &articleCursor{Sort: sort, ID: article.ID}
+	if sort == articleSortFavorites {
+		cursor.FavoriteCount = article.TotalFavoriteCount
+	} else {
+		cursor.CreatedAt = article.CreatedAt
+	}
+	return cursor
+}
+
+// encode はクライアントに返す不透明な文字列にする
+func (c *articleCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeArticleCursor は encode した文字列を読み込む(sort と異なる並び順のカーソルはエラーにする)
+func decodeArticleCursor(s string, sort articleSort) (*articleCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cursor := &articleCursor{}
+	if err := json.Unmarshal(b, cursor); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if cursor.Sort != sort || cursor.ID == "" {
+		return nil, errors.Newf("並び順が異なるカーソルです。: %s", cursor.Sort)
+	}
+	return cursor, nil
+}
+
+// articleListQuery は記事一覧の条件
+type articleListQuery struct {
+	Sort  articleSort
+	After *articleCursor // nilの場合は先頭から
+	Limit int
+}
+
+// less は sort の順で a が b より前かどうかを返す
+func (q *articleListQuery) less(a, b *articleCursor) bool {
+	switch q.Sort {
+	case articleSortOldest:
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	case articleSortFavorites:
+		if a.FavoriteCount != b.FavoriteCount {
+			return a.FavoriteCount > b.FavoriteCount
+		}
+		return a.ID > b.ID
+	}
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.ID > b.ID
+}
@@ -5,16 +5,28 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 )
 
 func newConnection(host, port, user, pass, name, sslMode string) (*sql.DB, error) {
+	return newConnectionWithCredentials(host, port, user, staticCredentials(pass), name, sslMode)
+}
+
+// newConnectionWithCredentials は新しい接続を作る度に credentials からパスワードを取得する
+func newConnectionWithCredentials(host, port, user string, credentials credentialsProvider, name, sslMode string) (*sql.DB, error) {
 	if port == "" {
 		port = "5432"
 	}
@@ -24,14 +36,178 @@ func newConnection(host, port, user, pass, name, sslMode string) (*sql.DB, error
 	if sslMode == "" {
 		sslMode = "require"
 	}
-	conn, err := sql.Open("postgres", fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		host, port, user, pass, name, sslMode,
-	))
+	dsn := fmt.Sprintf(
+		"host=%s port=%s user=%s dbname=%s sslmode=%s",
+		host, port, user, name, sslMode,
+	)
+	if _, err := pq.NewConnector(dsn); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return sql.OpenDB(&credentialsConnector{dsn: dsn, credentials: credentials}), nil
+}
+
+// dbConfig は接続設定
+type dbConfig struct {
+	Host        string   // ライターのエンドポイント
+	ReaderHosts []string // リーダーのエンドポイント
+	Port        string
+	User        string
+	Pass        string
+	Name        string
+	SSLMode     string
+	Auth        string // password, dsql, rds-iam
+	Driver      string // pq, pgx
+	Dialect     string // postgres, dsql, limitless
+	// Role は同じ接続先に複数の接続プールを作る場合にメトリクスで区別するための用途(空の場合はdefault)
+	Role string
+}
+
+// dbConfigFromEnv は DB_* の環境変数から接続設定を読み込む
+func dbConfigFromEnv() *dbConfig {
+	return dbConfigFromEnvPrefix("")
+}
+
+// dbConfigFromEnvPrefix は <prefix>DB_* の環境変数から接続設定を読み込む
+// 接頭辞付きの環境変数が無い項目は DB_* の値を使う
+func dbConfigFromEnvPrefix(prefix string) *dbConfig {
+	getenv := prefixedGetenv(prefix)
+	readerHosts := make([]string, 0)
+	for _, host := range strings.Split(getenv("DB_READER_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			readerHosts = append(readerHosts, host)
+		}
+	}
+	return &dbConfig{
+		Host:        getenv("DB_HOST"),
+		ReaderHosts: readerHosts,
+		Port:        getenv("DB_PORT"),
+		User:        getenv("DB_USER"),
+		Pass:        getenv("DB_PASS"),
+		Name:        getenv("DB_NAME"),
+		SSLMode:     getenv("DB_SSL"),
+		Auth:        getenv("DB_AUTH"),
+		Driver:      getenv("DB_DRIVER"),
+		Dialect:     getenv("DB_DIALECT"),
+	}
+}
+
+// prefixedGetenv は <prefix><key> の環境変数があればその値を、無ければ <key> の値を返す関数を返す
+func prefixedGetenv(prefix string) func(key string) string {
+	return func(key string) string {
+		if v, ok := os.LookupEnv(prefix + key); ok {
+			return v
+		}
+		return os.Getenv(key)
+	}
+}
+
+// newConnectionFromConfig は conf の接続設定と認証方式で host に接続する
+// Driver に pgx を指定すると lib/pq の代わりに pgxpool を使う
+func newConnectionFromConfig(conf *dbConfig, host string) (*sql.DB, dbPoolInfo, error) {
+	portNum, err := parsePort(conf.Port)
+	if err != nil {
+		return nil, dbPoolInfo{}, errors.WithStack(err)
+	}
+	credentials, err := newCredentials(conf.Auth, conf.Pass, host, portNum, conf.User)
+	if err != nil {
+		return nil, dbPoolInfo{}, errors.WithStack(err)
+	}
+	info := dbPoolInfo{address: host, port: portNum, name: conf.Name, driver: conf.Driver}
+
+	switch info.driver {
+	case "", driverPQ:
+		info.driver = driverPQ
+		conn, err := newConnectionWithCredentials(host, conf.Port, conf.User, credentials, conf.Name, conf.SSLMode)
+		if err != nil {
+			return nil, dbPoolInfo{}, errors.WithStack(err)
+		}
+		return conn, info, nil
+	case driverPgx:
+		conn, pool, err := newPgxConnection(host, conf.Port, conf.User, credentials, conf.Name, conf.SSLMode)
+		if err != nil {
+			return nil, dbPoolInfo{}, errors.WithStack(err)
+		}
+		info.pgxPool = pool
+		return conn, info, nil
+	}
+	return nil, dbPoolInfo{}, errors.Newf("未対応のDB_DRIVERです。: %s", info.driver)
+}
+
+func parsePort(port string) (int, error) {
+	if port == "" {
+		return 5432, nil
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return portNum, nil
+}
+
+// newDBExt はライター/リーダーの接続を作成する
+// ReaderHosts にリーダーエンドポイントを指定すると、トランザクション外の参照クエリはそちらに振り分けられる
+func newDBExt(conf *dbConfig) (*dbExt, error) {
+	redactor, err := newArgRedactorFromEnv()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return conn, nil
+
+	writer, info, err := newConnectionFromConfig(conf, conf.Host)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pools := map[*sql.DB]dbPoolInfo{
+		writer: info,
+	}
+	readers := make([]*sql.DB, 0, len(conf.ReaderHosts))
+	for _, host := range conf.ReaderHosts {
+		reader, info, err := newConnectionFromConfig(conf, host)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		readers = append(readers, reader)
+		pools[reader] = info
+	}
+	slowLog, err := newSlowQueryLogFromEnv()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	d, err := parseDialect(conf.Dialect)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	role := conf.Role
+	if role == "" {
+		role = dbRoleDefault
+	}
+	e := &dbExt{db: writer, readers: readers, pools: pools, redactor: redactor, slowLog: slowLog, dialect: d, role: role}
+
+	stmtCacheSize := 64
+	if v := os.Getenv("APP_STMT_CACHE_SIZE"); v != "" {
+		if stmtCacheSize, err = strconv.Atoi(v); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if stmtCacheSize > 0 {
+		e.stmtCache = newStmtCache(writer, stmtCacheSize)
+	}
+	if e.poolMetrics, err = registerPoolMetrics(e); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return e, nil
+}
+
+type readYourWritesKey struct{}
+
+// withReadYourWrites はトランザクション外の参照クエリもライターに向ける
+// 直前の書き込みをレプリカ遅延なしで読みたいリクエストで使う
+func withReadYourWrites(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readYourWritesKey{}, true)
+}
+
+func isReadYourWrites(ctx context.Context) bool {
+	v, _ := ctx.Value(readYourWritesKey{}).(bool)
+	return v
 }
 
 func toAttributes(attrMap map[string]any) []attribute.KeyValue {
@@ -52,6 +228,12 @@ func toAttributes(attrMap map[string]any) []attribute.KeyValue {
 			attrs = append(attrs, attribute.Float64("blog."+k, v))
 		case string:
 			attrs = append(attrs, attribute.String("blog."+k, v))
+		case []byte:
+			attrs = append(attrs, attribute.String("blog."+k, string(v)))
+		case time.Time:
+			attrs = append(attrs, attribute.String("blog."+k, v.Format(time.RFC3339Nano)))
+		case nil:
+			attrs = append(attrs, attribute.String("blog."+k, "NULL"))
 		case fmt.Stringer:
 			attrs = append(attrs, attribute.String("blog."+k, v.String()))
 		}
@@ -59,43 +241,295 @@ func toAttributes(attrMap map[string]any) []attribute.KeyValue {
 	return attrs
 }
 
-type dbExt struct {
-	db *sql.DB
+// txErrorClass はトランザクションのエラーをリトライ可否で分類したもの
+type txErrorClass string
+
+const (
+	txErrorClassSerializationFailure txErrorClass = "serialization_failure" // 40001
+	txErrorClassDeadlock             txErrorClass = "deadlock"              // 40P01
+	txErrorClassDSQLConflict         txErrorClass = "dsql_occ_conflict"     // DSQLのOCC(データ競合) OC000
+	txErrorClassDSQLSchemaChanged    txErrorClass = "dsql_occ_schema"       // DSQLのOCC(スキーマ変更) OC001
+)
+
+// sqlState はlib/pqとpgxのどちらのエラーからもSQLSTATEとメッセージを取り出す
+func sqlState(err error) (code, message string, ok bool) {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code), pqErr.Message, true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code, pgErr.Message, true
+	}
+	return "", "", false
 }
 
-func (e *dbExt) Transaction(ctx context.Context, f func(ctx context.Context, tx *txExt) error) (err error) {
-	ctx, span1 := tracer.Start(ctx, "Transaction")
+// isUniqueViolation は一意制約違反(SQLSTATE 23505)かどうかを返す
+func isUniqueViolation(err error) bool {
+	code, _, ok := sqlState(err)
+	return ok && code == "23505"
+}
+
+// classifyTxError はリトライすべきエラーであればその分類とtrueを返す
+// DSQLのOCCエラーはSQLSTATE 40001で返ってくるため、メッセージ中のコードで判別する
+func classifyTxError(err error) (txErrorClass, bool) {
+	code, message, ok := sqlState(err)
+	if !ok {
+		return "", false
+	}
+	switch code {
+	case "40001":
+		switch {
+		case strings.Contains(message, "OC000"):
+			return txErrorClassDSQLConflict, true
+		case strings.Contains(message, "OC001"):
+			return txErrorClassDSQLSchemaChanged, true
+		}
+		return txErrorClassSerializationFailure, true
+	case "40P01":
+		return txErrorClassDeadlock, true
+	}
+	return "", false
+}
+
+// txOptions はTransactionの実行方法を表す
+type txOptions struct {
+	name      string
+	isolation sql.IsolationLevel
+	readOnly  bool
+	// newBackOff はリトライポリシー(nilの場合はnewDefaultBackOff)
+	newBackOff func() backoff.BackOff
+}
+
+// backOff はリトライポリシーを生成する
+func (o *txOptions) backOff(ctx context.Context) backoff.BackOff {
+	if o.newBackOff != nil {
+		// withBackOffで指定されたポリシーは呼び出し元の意図通りに使う
+		return o.newBackOff()
+	}
+	b := newDefaultBackOff()
+	if _, ok := ctx.Deadline(); ok {
+		// 呼び出し元のデッドラインがある場合は固定の経過時間ではなくそちらに従う
+		b.MaxElapsedTime = 0
+	}
+	return b
+}
 
+type txOption func(o *txOptions)
+
+// withTxName はメトリクスとスパンに載せるトランザクション名を指定する ex) post_favorite
+func withTxName(name string) txOption {
+	return func(o *txOptions) {
+		o.name = name
+	}
+}
+
+// withIsolationLevel はトランザクションの分離レベルを指定する
+func withIsolationLevel(level sql.IsolationLevel) txOption {
+	return func(o *txOptions) {
+		o.isolation = level
+	}
+}
+
+// withReadOnly は読み取り専用トランザクションにする
+func withReadOnly() txOption {
+	return func(o *txOptions) {
+		o.readOnly = true
+	}
+}
+
+// withBackOff はリトライポリシーを差し替える
+// BackOffは状態を持つため、Transactionの呼び出し毎に生成する
+func withBackOff(newBackOff func() backoff.BackOff) txOption {
+	return func(o *txOptions) {
+		o.newBackOff = newBackOff
+	}
+}
+
+// withoutRetry はリトライ可能なエラーであってもリトライしない
+func withoutRetry() txOption {
+	return withBackOff(func() backoff.BackOff {
+		return &backoff.StopBackOff{}
+	})
+}
+
+func newDefaultBackOff() *backoff.ExponentialBackOff {
 	b := backoff.NewExponentialBackOff()
 	b.InitialInterval = 2 * time.Second
 	b.RandomizationFactor = 0.5
 	b.Multiplier = 2
 	b.MaxElapsedTime = 60 * time.Second
+	return b
+}
+
+const dbPoolWriter = "writer"
+
+// 接続プールの用途 ex) サーバーとアウトボックスのリレーが同じライターに別のプールを持つ
+const (
+	dbRoleDefault = "default"
+	dbRoleSweeper = "sweeper"
+	dbRoleOutbox  = "outbox"
+)
+
+// txNameUnnamed は withTxName を指定しなかったトランザクションの名前
+const txNameUnnamed = "unnamed"
+
+// トランザクションのメトリクスは呼び出し元のスパンの中で記録するため、サンプリングされたトレースがexemplarとして付く
+var (
+	txDuration, _ = meter.Float64Histogram(
+		"blog.db.transaction.duration",
+		metric.WithDescription("リトライを含めたトランザクションの所要時間"),
+		metric.WithUnit("s"),
+	)
+	txRetries, _ = meter.Int64Histogram(
+		"blog.db.transaction.retries",
+		metric.WithDescription("トランザクションのリトライ回数"),
+		metric.WithExplicitBucketBoundaries(0, 1, 2, 3, 5, 8, 13),
+	)
+	txErrors, _ = meter.Int64Counter(
+		"blog.db.transaction.errors",
+		metric.WithDescription("SQLSTATE毎のトランザクションのエラー数(リトライしたものを含む)"),
+	)
+)
+
+type dbExt struct {
+	db *sql.DB // ライター
+	// readers はリーダーの接続プール(空の場合は全てライターに向ける)
+	readers    []*sql.DB
+	readerNext atomic.Uint64
+	// pools はトレースに載せる接続プール毎の接続先
+	pools map[*sql.DB]dbPoolInfo
+	// redactor はスパン属性に載せる引数の伏せ字設定(nilの場合はデフォルト)
+	redactor *argRedactor
+	// stmtCache はトランザクションを跨いで使うプリペアドステートメント(nilの場合は毎回準備する)
+	stmtCache *stmtCache
+	// poolMetrics は接続プールのメトリクスのコールバック(nilの場合は未登録)
+	poolMetrics metric.Registration
+	// txOptions は全てのTransactionに適用されるオプション(呼び出し毎のオプションで上書きされる)
+	txOptions []txOption
+	// slowLog はスロークエリログ(nilの場合は出力しない)
+	slowLog *slowQueryLog
+	// dialect はセーブポイントを使えるかどうかの判定に使う(空の場合はPostgres)
+	dialect dialect
+	// role は接続プールのメトリクスに載せる用途
+	role string
+}
+
+// reader はトランザクション外の参照クエリに使う接続プールとその名前を返す
+func (e *dbExt) reader(ctx context.Context) (*sql.DB, string) {
+	if len(e.readers) == 0 || isReadYourWrites(ctx) {
+		return e.db, dbPoolWriter
+	}
+	i := (e.readerNext.Add(1) - 1) % uint64(len(e.readers))
+	return e.readers[i], "reader-" + strconv.FormatUint(i, 10)
+}
+
+func (e *dbExt) PingContext(ctx context.Context) error {
+	for _, db := range append([]*sql.DB{e.db}, e.readers...) {
+		if err := db.PingContext(ctx); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// Close は全ての接続プールを閉じる
+func (e *dbExt) Close() error {
+	var err error
+	if e.poolMetrics != nil {
+		err = errors.Join(err, e.poolMetrics.Unregister())
+	}
+	if e.stmtCache != nil {
+		err = errors.Join(err, e.stmtCache.Close())
+	}
+	for _, db := range append([]*sql.DB{e.db}, e.readers...) {
+		err = errors.Join(err, db.Close())
+		if info, ok := e.pools[db]; ok && info.pgxPool != nil {
+			info.pgxPool.Close()
+		}
+	}
+	return errors.WithStack(err)
+}
+
+func (e *dbExt) Transaction(ctx context.Context, f func(ctx context.Context, tx *txExt) error, opts ...txOption) (err error) {
+	ctx, span1 := tracer.Start(ctx, "Transaction")
+
+	start := time.Now()
+	o := &txOptions{
+		name: txNameUnnamed,
+	}
+	for _, opt := range append(e.txOptions, opts...) {
+		opt(o)
+	}
+	b := o.backOff(ctx)
 	execCount := 0
+	retryCounts := make(map[txErrorClass]int)
+	// committed はコミットできた試行のtxExt
+	var committed *txExt
 
 	defer func() {
-		span1.SetAttributes(toAttributes(map[string]any{
-			"exec_count": execCount,
-		})...)
+		attrs := map[string]any{
+			"tx_name":         o.name,
+			"exec_count":      execCount,
+			"db_pool":         dbPoolWriter,
+			"isolation_level": o.isolation,
+			"read_only":       o.readOnly,
+		}
+		for class, count := range retryCounts {
+			attrs["retry_count."+string(class)] = count
+		}
+		span1.SetAttributes(toAttributes(attrs)...)
 		span1.End()
+
+		txName := attribute.String("tx_name", o.name)
+		txDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(txName, attribute.Bool("committed", err == nil)))
+		txRetries.Record(ctx, int64(execCount-1), metric.WithAttributes(txName))
 	}()
 
-	if err := backoff.Retry(func() error {
+	if err := backoff.Retry(func() (err error) {
 		execCount++
 
+		// リトライ可能なエラー以外は即座に失敗させる
+		defer func() {
+			if err == nil {
+				return
+			}
+			class, ok := classifyTxError(err)
+			if code, _, hasCode := sqlState(err); hasCode {
+				if !ok {
+					class = "other"
+				}
+				txErrors.Add(ctx, 1, metric.WithAttributes(
+					attribute.String("tx_name", o.name),
+					attribute.String("sqlstate", code),
+					attribute.String("error_class", string(class)),
+					attribute.Bool("retryable", ok),
+				))
+			}
+			if !ok {
+				err = backoff.Permanent(err)
+				return
+			}
+			retryCounts[class]++
+		}()
+
 		var tx *sql.Tx
-		ctx, span2 := tracer.Start(ctx, "BeginTx")
-		tx, err = e.db.BeginTx(ctx, nil)
+		ctx, span2 := e.startSpan(ctx, "BeginTx", e.db, "BEGIN", nil)
+		tx, err = e.db.BeginTx(ctx, &sql.TxOptions{
+			Isolation: o.isolation,
+			ReadOnly:  o.readOnly,
+		})
 		span2.End()
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		txe := &txExt{tx: tx, dbExt: e}
 
 		defer func() {
 			ctx = trace.ContextWithSpan(ctx, span1)
 
 			if p := recover(); p != nil {
-				_, span3 := tracer.Start(ctx, "Rollback")
+				_, span3 := e.startSpan(ctx, "Rollback", e.db, "ROLLBACK", nil)
 				defer span3.End()
 				e := tx.Rollback()
 				if e != nil {
@@ -105,7 +539,7 @@ func (e *dbExt) Transaction(ctx context.Context, f func(ctx context.Context, tx
 			}
 
 			if err != nil {
-				_, span3 := tracer.Start(ctx, "Rollback")
+				_, span3 := e.startSpan(ctx, "Rollback", e.db, "ROLLBACK", nil)
 				defer span3.End()
 				e := tx.Rollback()
 				if e != nil {
@@ -115,38 +549,42 @@ func (e *dbExt) Transaction(ctx context.Context, f func(ctx context.Context, tx
 			}
 
 			// 正常
-			_, span3 := tracer.Start(ctx, "Commit")
+			// DSQLのOCCはコミット時に検出されるため、コミットのエラーもリトライ判定の対象にする
+			_, span3 := e.startSpan(ctx, "Commit", e.db, "COMMIT", nil)
 			defer span3.End()
 			if e := tx.Commit(); e != nil {
 				err = errors.WithStack(e)
+				return
 			}
+			committed = txe
 		}()
 
 		ctx = trace.ContextWithSpan(ctx, span1)
 		ctx, span4 := tracer.Start(ctx, "Callback")
 		defer span4.End()
-		if err = f(ctx, &txExt{tx}); err != nil {
+		if err = f(ctx, txe); err != nil {
 			return errors.WithStack(err)
 		}
 
 		return nil
-	}, b); err != nil {
+	}, backoff.WithContext(b, ctx)); err != nil {
 		return errors.WithStack(err)
 	}
+	committed.runAfterCommit(ctx)
 	return nil
 }
 
 func (e *dbExt) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
-	ctx, span := tracer.Start(ctx, "QueryContext")
+	db, pool := e.reader(ctx)
+	ctx, span := e.startSpan(ctx, "QueryContext", db, query, args)
 	defer span.End()
-	m := make(map[string]any)
-	for i, arg := range args {
-		m["arg"+strconv.FormatInt(int64(i), 10)] = arg
-	}
-	m["query"] = query
-	span.SetAttributes(toAttributes(m)...)
+	span.SetAttributes(toAttributes(map[string]any{
+		"db_pool": pool,
+	})...)
 
-	rows, err := e.db.QueryContext(ctx, query, args...)
+	done := e.observeQuery(ctx, "QueryContext", query, args)
+	rows, err := db.QueryContext(ctx, query, args...)
+	done(-1, err)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -154,55 +592,206 @@ func (e *dbExt) QueryContext(ctx context.Context, query string, args ...any) (*s
 }
 
 func (e *dbExt) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
-	ctx, span := tracer.Start(ctx, "QueryRowContext")
+	db, pool := e.reader(ctx)
+	ctx, span := e.startSpan(ctx, "QueryRowContext", db, query, args)
 	defer span.End()
-	m := make(map[string]any)
-	for i, arg := range args {
-		m["arg"+strconv.FormatInt(int64(i), 10)] = arg
-	}
-	m["query"] = query
-	span.SetAttributes(toAttributes(m)...)
+	span.SetAttributes(toAttributes(map[string]any{
+		"db_pool": pool,
+	})...)
 
-	row := e.db.QueryRowContext(ctx, query, args...)
+	done := e.observeQuery(ctx, "QueryRowContext", query, args)
+	row := db.QueryRowContext(ctx, query, args...)
+	done(-1, row.Err())
 	return row
 }
 
 type txExt struct {
-	tx *sql.Tx
+	tx    *sql.Tx
+	dbExt *dbExt
+	// afterCommit はコミット後に実行する関数(リトライ毎に新しいtxExtを作るので、ロールバックした試行の関数は捨てられる)
+	afterCommit []func(ctx context.Context) error
+	// depth はネストしたTransactionの深さ(セーブポイントの名前に使う)
+	depth int
+	// snapshot はインメモリ実装のセーブポイント(戻す関数を返す)。nilの場合はSQLのSAVEPOINTを使う
+	snapshot func() (restore func())
 }
 
-func (e *txExt) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
-	ctx, span := tracer.Start(ctx, "QueryRowContext")
+// errSavepointUnsupported はセーブポイントを使えないバックエンドでネストしたTransactionを呼び出した場合のエラー
+var errSavepointUnsupported = errors.New("このバックエンドはセーブポイントに対応していないため、ネストしたトランザクションを使えません。")
+
+// Transaction はセーブポイントを作成して f を実行し、エラーの場合はセーブポイントまでロールバックする
+// f 内で登録したコミット後の関数は、f が成功した場合のみ外側のトランザクションに引き継ぐ
+// シリアライズ失敗などのリトライ可能なエラーは外側のトランザクション全体をやり直す必要があるため、そのまま返す
+// DSQLなどセーブポイントを使えないバックエンドでは何も実行せずに errSavepointUnsupported を返す
+func (e *txExt) Transaction(ctx context.Context, f func(ctx context.Context, tx *txExt) error) (err error) {
+	if e.snapshot == nil && !e.dbExt.dialect.Savepoints() {
+		return errors.WithStack(errSavepointUnsupported)
+	}
+	ctx, span := tracer.Start(ctx, "Savepoint", trace.WithAttributes(attribute.Int("depth", e.depth+1)))
+	defer span.End()
+
+	child := &txExt{tx: e.tx, dbExt: e.dbExt, depth: e.depth + 1, snapshot: e.snapshot}
+	if e.snapshot != nil {
+		restore := e.snapshot()
+		defer func() {
+			if p := recover(); p != nil {
+				restore()
+				panic(p)
+			}
+			if err != nil {
+				restore()
+				return
+			}
+			e.afterCommit = append(e.afterCommit, child.afterCommit...)
+		}()
+		return errors.WithStack(f(ctx, child))
+	}
+
+	name := "sp_" + strconv.Itoa(child.depth)
+	if err := e.exec(ctx, "SAVEPOINT "+name); err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			if e2 := e.exec(ctx, "ROLLBACK TO SAVEPOINT "+name); e2 != nil {
+				log.Printf("セーブポイントまでのロールバックに失敗しました。: %+v\n", e2)
+			}
+			panic(p)
+		}
+		if err != nil {
+			if e2 := e.exec(ctx, "ROLLBACK TO SAVEPOINT "+name); e2 != nil {
+				err = errors.Join(err, e2)
+			}
+			return
+		}
+		if err = e.exec(ctx, "RELEASE SAVEPOINT "+name); err != nil {
+			return
+		}
+		e.afterCommit = append(e.afterCommit, child.afterCommit...)
+	}()
+	return errors.WithStack(f(ctx, child))
+}
+
+// exec は引数の無い文を実行する(SAVEPOINTはプリペアドステートメントにできないため直接実行する)
+func (e *txExt) exec(ctx context.Context, query string) error {
+	ctx, span := e.dbExt.startSpan(ctx, "ExecContext", e.dbExt.db, query, nil)
+	defer span.End()
+
+	done := e.dbExt.observeQuery(ctx, "ExecContext", query, nil)
+	_, err := e.tx.ExecContext(ctx, query)
+	done(-1, err)
+	return errors.WithStack(err)
+}
+
+// AfterCommit はトランザクションがコミットされた後に1回だけ実行する関数を登録する
+// キャッシュの破棄やイベントの配信、メトリクスのように、ロールバックやリトライされた試行では実行してはいけない処理に使う
+// 関数のエラーはスパンとログに記録するだけで、Transactionの結果には影響しない(既にコミット済みのため)
+func (e *txExt) AfterCommit(f func(ctx context.Context) error) {
+	e.afterCommit = append(e.afterCommit, f)
+}
+
+// runAfterCommit は登録順に関数を実行する(関数毎に子スパンを作る)
+func (e *txExt) runAfterCommit(ctx context.Context) {
+	for i, f := range e.afterCommit {
+		func() {
+			ctx, span := tracer.Start(ctx, "AfterCommit", trace.WithAttributes(attribute.Int("index", i)))
+			defer span.End()
+			if err := f(ctx); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				log.Printf("コミット後の処理に失敗しました。: %+v\n", err)
+			}
+		}()
+	}
+}
+
+func (e *txExt) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, span := e.dbExt.startSpan(ctx, "QueryContext", e.dbExt.db, query, args)
+	defer span.End()
+
+	done := e.dbExt.observeQuery(ctx, "QueryContext", query, args)
+	rows, err := e.tx.QueryContext(ctx, query, args...)
+	done(-1, err)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return rows, nil
+}
+
+// ExecContext はステートメントを準備せずに実行する
+// 引数の数によってSQL文が変わるものはステートメントキャッシュを使わずにこちらで実行する
+func (e *txExt) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := e.dbExt.startSpan(ctx, "ExecContext", e.dbExt.db, query, args)
 	defer span.End()
-	m := make(map[string]any)
-	for i, arg := range args {
-		m["arg"+strconv.FormatInt(int64(i), 10)] = arg
+
+	done := e.dbExt.observeQuery(ctx, "ExecContext", query, args)
+	result, err := e.tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		done(-1, err)
+		return nil, errors.WithStack(err)
 	}
-	m["query"] = query
-	span.SetAttributes(toAttributes(m)...)
+	rowsAffected, _ := result.RowsAffected()
+	done(rowsAffected, nil)
+	return result, nil
+}
 
+func (e *txExt) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := e.dbExt.startSpan(ctx, "QueryRowContext", e.dbExt.db, query, args)
+	defer span.End()
+
+	done := e.dbExt.observeQuery(ctx, "QueryRowContext", query, args)
 	row := e.tx.QueryRowContext(ctx, query, args...)
+	done(-1, row.Err())
 	return row
 }
 
 func (e *txExt) PrepareContext(ctx context.Context, query string) (*stmtExt, error) {
-	ctx, span := tracer.Start(ctx, "PrepareContext")
+	ctx, span := e.dbExt.startSpan(ctx, "PrepareContext", e.dbExt.db, query, nil)
 	defer span.End()
-	span.SetAttributes(toAttributes(map[string]any{
-		"query": query,
-	})...)
+	start := time.Now()
+	defer func() {
+		queryStatsFromContext(ctx).addPrepare(time.Since(start))
+	}()
+
+	if e.dbExt.stmtCache != nil {
+		cached, hit := e.dbExt.stmtCache.get(ctx, query)
+		span.SetAttributes(toAttributes(map[string]any{
+			"stmt_cache_hit": hit,
+		})...)
+		if hit {
+			return &stmtExt{
+				stmt:   e.tx.StmtContext(ctx, cached),
+				query:  query,
+				dbExt:  e.dbExt,
+				cached: true,
+			}, nil
+		}
+	}
 
 	stmt, err := e.tx.PrepareContext(ctx, query)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	return &stmtExt{
-		stmt: stmt,
+		stmt:  stmt,
+		query: query,
+		dbExt: e.dbExt,
 	}, nil
 }
 
 type stmtExt struct {
-	stmt *sql.Stmt
+	stmt  *sql.Stmt
+	query string
+	dbExt *dbExt
+	// cached はstmtCacheから取得したステートメントかどうか
+	cached bool
+}
+
+// invalidateOnError は使えなくなったステートメントをキャッシュから破棄する
+func (e *stmtExt) invalidateOnError(ctx context.Context, err error) {
+	if err != nil && e.cached && isStmtInvalidated(err) {
+		e.dbExt.stmtCache.invalidate(ctx, e.query)
+	}
 }
 
 func (e *stmtExt) Close() error {
@@ -210,31 +799,29 @@ func (e *stmtExt) Close() error {
 }
 
 func (e *stmtExt) QueryRowContext(ctx context.Context, args ...any) *sql.Row {
-	ctx, span := tracer.Start(ctx, "QueryRowContext")
+	ctx, span := e.dbExt.startSpan(ctx, "QueryRowContext", e.dbExt.db, e.query, args)
 	defer span.End()
-	m := make(map[string]any)
-	for i, arg := range args {
-		m["arg"+strconv.FormatInt(int64(i), 10)] = arg
-	}
-	span.SetAttributes(toAttributes(m)...)
 
+	done := e.dbExt.observeQuery(ctx, "QueryRowContext", e.query, args)
 	row := e.stmt.QueryRowContext(ctx, args...)
+	done(-1, row.Err())
+	e.invalidateOnError(ctx, row.Err())
 	return row
 }
 
 func (e *stmtExt) ExecContext(ctx context.Context, args ...any) (sql.Result, error) {
-	ctx, span := tracer.Start(ctx, "ExecContext")
+	ctx, span := e.dbExt.startSpan(ctx, "ExecContext", e.dbExt.db, e.query, args)
 	defer span.End()
-	m := make(map[string]any)
-	for i, arg := range args {
-		m["arg"+strconv.FormatInt(int64(i), 10)] = arg
-	}
-	span.SetAttributes(toAttributes(m)...)
 
+	done := e.dbExt.observeQuery(ctx, "ExecContext", e.query, args)
 	result, err := e.stmt.ExecContext(ctx, args...)
 	if err != nil {
+		done(-1, err)
+		e.invalidateOnError(ctx, err)
 		return nil, errors.WithStack(err)
 	}
+	rowsAffected, _ := result.RowsAffected()
+	done(rowsAffected, nil)
 	return result, nil
 }
 
@@ -253,10 +840,32 @@ type Article struct {
 	Body               string    `db:"body" json:"body"`
 	UserID             string    `db:"user_id" json:"user_id"`
 	TotalFavoriteCount int       `db:"total_favorite_count" json:"total_favorite_count"`
+	Version            int64     `db:"version" json:"version"`
 	CreatedAt          time.Time `db:"created_at" json:"created_at"`
 	UpdatedAt          time.Time `db:"updated_at" json:"updated_at"`
 }
 
+// IdempotencyKey は Idempotency-Key を指定したリクエストの最初のレスポンス
+type IdempotencyKey struct {
+	Scope       string    `db:"scope" json:"scope"`
+	Key         string    `db:"idempotency_key" json:"idempotency_key"`
+	RequestHash string    `db:"request_hash" json:"request_hash"`
+	Status      int       `db:"status" json:"status"` // 0は処理中
+	ContentType string    `db:"content_type" json:"content_type"`
+	Body        string    `db:"body" json:"body"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+	ExpiresAt   time.Time `db:"expires_at" json:"expires_at"`
+}
+
+// OutboxEvent は記事やお気に入りの変更イベント(payload はJSON)
+type OutboxEvent struct {
+	ID          string    `db:"id" json:"id"`
+	EventType   string    `db:"event_type" json:"event_type"`
+	AggregateID string    `db:"aggregate_id" json:"aggregate_id"`
+	Payload     string    `db:"payload" json:"payload"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
 type UserArticle struct {
 	UserID    string    `db:"user_id" json:"user_id"`
 	ArticleID string    `db:"article_id" json:"article_id"`
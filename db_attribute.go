@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// dbPoolInfo は接続プールの接続先とドライバー(トレースの server.address やプールのメトリクスに使う)
+type dbPoolInfo struct {
+	address string
+	port    int
+	name    string
+	driver  string
+	// pgxPool は driver が pgx の場合の下位のプール
+	pgxPool *pgxpool.Pool
+}
+
+const redactedValue = "[REDACTED]"
+
+// argRedactor はスパン属性に載せるSQLの引数を伏せる
+type argRedactor struct {
+	// denyColumns に列名がマッチした引数は伏せる
+	denyColumns []*regexp.Regexp
+	// denyValues に値がマッチした引数は伏せる(列名が分からないクエリ向け)
+	denyValues []*regexp.Regexp
+	// maxLength を超える文字列は切り詰める(0以下なら切り詰めない)
+	maxLength int
+}
+
+var defaultArgRedactor = &argRedactor{
+	denyColumns: []*regexp.Regexp{
+		regexp.MustCompile(`(?i)password|secret|token|email`),
+	},
+	denyValues: []*regexp.Regexp{
+		regexp.MustCompile(`^\$2[abxy]?\$\d{2}\$`), // bcryptのハッシュ
+		regexp.MustCompile(`^[^@\s]+@[^@\s]+$`),    // メールアドレス
+	},
+	maxLength: 256,
+}
+
+// newArgRedactorFromEnv はデフォルトの設定に環境変数の設定を加える
+// APP_REDACT_DENY_COLUMNS, APP_REDACT_DENY_VALUES はカンマ区切りの正規表現
+func newArgRedactorFromEnv() (*argRedactor, error) {
+	r := &argRedactor{
+		denyColumns: append([]*regexp.Regexp{}, defaultArgRedactor.denyColumns...),
+		denyValues:  append([]*regexp.Regexp{}, defaultArgRedactor.denyValues...),
+		maxLength:   defaultArgRedactor.maxLength,
+	}
+	for env, patterns := range map[string]*[]*regexp.Regexp{
+		"APP_REDACT_DENY_COLUMNS": &r.denyColumns,
+		"APP_REDACT_DENY_VALUES":  &r.denyValues,
+	} {
+		for _, pattern := range strings.Split(os.Getenv(env), ",") {
+			if pattern == "" {
+				continue
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%sの正規表現が不正です。", env)
+			}
+			*patterns = append(*patterns, re)
+		}
+	}
+	if v := os.Getenv("APP_REDACT_MAX_LENGTH"); v != "" {
+		maxLength, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		r.maxLength = maxLength
+	}
+	return r, nil
+}
+
+var (
+	insertColumnsRegexp = regexp.MustCompile(`(?is)^\s*INSERT\s+INTO\s+\S+\s*\(([^)]*)\)\s*VALUES\s*\(([^)]*)\)`)
+	comparisonRegexp    = regexp.MustCompile(`"?(\w+)"?\s*(?:=|<>|!=|<=|>=|<|>)\s*\$(\d+)`)
+)
+
+// argColumns はクエリからプレースホルダの番号と列名の対応を推測する
+func argColumns(query string) map[int]string {
+	columns := make(map[int]string)
+	if m := insertColumnsRegexp.FindStringSubmatch(query); m != nil {
+		names := strings.Split(m[1], ",")
+		values := strings.Split(m[2], ",")
+		for i := 0; i < len(names) && i < len(values); i++ {
+			n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(values[i]), "$"))
+			if err != nil {
+				continue
+			}
+			columns[n] = strings.Trim(strings.TrimSpace(names[i]), `"`)
+		}
+	}
+	for _, m := range comparisonRegexp.FindAllStringSubmatch(query, -1) {
+		n, err := strconv.Atoi(m[2])
+		if err != nil {
+			continue
+		}
+		columns[n] = m[1]
+	}
+	return columns
+}
+
+// redact はクエリの引数を伏せ字や切り詰めを適用したスパン属性用のmapにする
+func (r *argRedactor) redact(query string, args []any) map[string]any {
+	columns := argColumns(query)
+	m := make(map[string]any, len(args))
+	for i, arg := range args {
+		if v, ok := arg.(driver.Valuer); ok {
+			if value, err := v.Value(); err == nil {
+				arg = value
+			}
+		}
+		key := "arg" + strconv.FormatInt(int64(i), 10)
+		if r.denied(columns[i+1], arg) {
+			m[key] = redactedValue
+			continue
+		}
+		switch v := arg.(type) {
+		case string:
+			m[key] = r.truncate(v)
+		case []byte:
+			m[key] = r.truncate(string(v))
+		default:
+			m[key] = arg
+		}
+	}
+	return m
+}
+
+func (r *argRedactor) denied(column string, arg any) bool {
+	if column != "" {
+		for _, re := range r.denyColumns {
+			if re.MatchString(column) {
+				return true
+			}
+		}
+	}
+	var value string
+	switch v := arg.(type) {
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	case fmt.Stringer:
+		if _, ok := v.(time.Time); ok {
+			return false
+		}
+		value = v.String()
+	default:
+		return false
+	}
+	for _, re := range r.denyValues {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *argRedactor) truncate(s string) string {
+	if r.maxLength <= 0 || len(s) <= r.maxLength {
+		return s
+	}
+	// マルチバイト文字の途中で切らない
+	end := r.maxLength
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end] + "..."
+}
+
+// operationName はクエリの先頭のキーワードを db.operation.name として返す
+func operationName(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
+
+// startSpan はDBのセマンティック規約に沿ったクライアントスパンを開始する
+func (e *dbExt) startSpan(ctx context.Context, spanName string, db *sql.DB, query string, args []any) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemPostgreSQL,
+		semconv.DBQueryText(query),
+		semconv.DBOperationName(operationName(query)),
+	}
+	if info, ok := e.pools[db]; ok {
+		attrs = append(attrs, semconv.ServerAddress(info.address), semconv.ServerPort(info.port))
+		if info.name != "" {
+			attrs = append(attrs, semconv.DBNamespace(info.name))
+		}
+		attrs = append(attrs, attribute.String("blog.db_driver", info.driver))
+	}
+	redactor := e.redactor
+	if redactor == nil {
+		redactor = defaultArgRedactor
+	}
+	attrs = append(attrs, toAttributes(redactor.redact(query, args))...)
+
+	return tracer.Start(ctx, spanName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
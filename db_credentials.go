@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/lib/pq"
+)
+
+// credentialsProvider は接続毎に使うパスワードを返す
+// IAM認証トークンのように期限のあるものは期限切れ前に作り直す
+type credentialsProvider interface {
+	Password(ctx context.Context) (string, error)
+}
+
+// staticCredentials は固定のパスワード
+type staticCredentials string
+
+func (c staticCredentials) Password(context.Context) (string, error) {
+	return string(c), nil
+}
+
+// awsCredentials はSigV4の署名に使うアクセスキー
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+const (
+	iamTokenServiceDSQL = "dsql"
+	iamTokenServiceRDS  = "rds-db"
+)
+
+// iamTokenCredentials はDSQLまたはRDSのIAM認証トークンをローカルで署名して作る(ネットワークアクセスは不要)
+type iamTokenCredentials struct {
+	service  string // dsql, rds-db
+	host     string
+	port     int
+	user     string
+	region   string
+	keys     awsCredentials
+	expires  time.Duration // トークンの有効期間
+	refresh  time.Duration // 有効期限のこの時間前になったら作り直す
+	now      func() time.Time
+	mu       sync.Mutex
+	token    string
+	expireAt time.Time
+}
+
+func (c *iamTokenCredentials) Password(context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if c.token != "" && now.Before(c.expireAt.Add(-c.refresh)) {
+		return c.token, nil
+	}
+	token, err := c.generate(now)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	c.token, c.expireAt = token, now.Add(c.expires)
+	return token, nil
+}
+
+// generate は署名済みURLからスキームを除いたものをトークンとして返す
+func (c *iamTokenCredentials) generate(now time.Time) (string, error) {
+	query := url.Values{}
+	host := c.host
+	switch c.service {
+	case iamTokenServiceDSQL:
+		// adminロールとそれ以外のロールでアクションが異なる
+		if c.user == "admin" {
+			query.Set("Action", "DbConnectAdmin")
+		} else {
+			query.Set("Action", "DbConnect")
+		}
+	case iamTokenServiceRDS:
+		query.Set("Action", "connect")
+		query.Set("DBUser", c.user)
+		host = host + ":" + strconv.Itoa(c.port)
+	default:
+		return "", errors.Newf("未対応のサービスです。: %s", c.service)
+	}
+	signed := presignURL(host, "/", query, c.service, c.region, c.keys, now, c.expires, emptyPayloadHash)
+	return strings.TrimPrefix(signed, "https://"), nil
+}
+
+// emptyPayloadHash は空のリクエストボディのSHA256
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// presignURL はAWS Signature Version 4のクエリ文字列署名をしたGETのURLを返す
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func presignURL(host, path string, query url.Values, service, region string, keys awsCredentials, now time.Time, expires time.Duration, payloadHash string) string {
+	now = now.UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", keys.accessKeyID+"/"+scope)
+	q.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", strconv.FormatInt(int64(expires/time.Second), 10))
+	q.Set("X-Amz-SignedHeaders", "host")
+	if keys.sessionToken != "" {
+		q.Set("X-Amz-Security-Token", keys.sessionToken)
+	}
+	canonicalQuery := canonicalQueryString(q)
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		path,
+		canonicalQuery,
+		"host:" + host + "\n",
+		"host",
+		payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		hexSHA256(canonicalRequest),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+keys.secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return "https://" + host + path + "?" + canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+// canonicalQueryString はキー順に並べてRFC3986でエンコードしたクエリ文字列を返す
+func canonicalQueryString(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range q[k] {
+			pairs = append(pairs, awsURIEncode(k)+"="+awsURIEncode(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func awsURIEncode(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hexSHA256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// newCredentials はDB_AUTHに応じた認証方式を返す
+// password(デフォルト): DB_PASS の固定パスワード
+// dsql, rds-iam: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION から署名したIAM認証トークン
+func newCredentials(auth, pass, host string, port int, user string) (credentialsProvider, error) {
+	var service string
+	switch auth {
+	case "", "password":
+		return staticCredentials(pass), nil
+	case "dsql":
+		service = iamTokenServiceDSQL
+	case "rds-iam":
+		service = iamTokenServiceRDS
+	default:
+		return nil, errors.Newf("未対応のDB_AUTHです。: %s", auth)
+	}
+
+	keys := awsCredentials{
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if keys.accessKeyID == "" || keys.secretAccessKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID と AWS_SECRET_ACCESS_KEY が必要です。")
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		return nil, errors.New("AWS_REGION が必要です。")
+	}
+	return &iamTokenCredentials{
+		service: service,
+		host:    host,
+		port:    port,
+		user:    user,
+		region:  region,
+		keys:    keys,
+		expires: 15 * time.Minute,
+		refresh: 5 * time.Minute,
+		now:     time.Now,
+	}, nil
+}
+
+// credentialsConnector は新しい接続を作る度にパスワードを取得する
+// コネクションプールが接続を作り直すときに期限切れのトークンを使わないようにするため
+type credentialsConnector struct {
+	dsn         string // パスワードを除いたDSN
+	credentials credentialsProvider
+}
+
+func (c *credentialsConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	password, err := c.credentials.Password(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	connector, err := pq.NewConnector(c.dsn + " password=" + quoteDSNValue(password))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	conn, err := connector.Connect(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return conn, nil
+}
+
+func (c *credentialsConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// quoteDSNValue はkey/value形式のDSNの値をクォートする
+func quoteDSNValue(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
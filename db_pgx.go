@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	driverPQ  = "pq"
+	driverPgx = "pgx"
+)
+
+// newPgxConnection はpgxpoolの上にdatabase/sqlの*sql.DBを作成する
+// dbExt、txExt、stmtExtはそのまま使えるので、ドライバーを変えても同じスパンツリーになる
+func newPgxConnection(host, port, user string, credentials credentialsProvider, name, sslMode string) (*sql.DB, *pgxpool.Pool, error) {
+	if port == "" {
+		port = "5432"
+	}
+	if name == "" {
+		name = "''"
+	}
+	if sslMode == "" {
+		sslMode = "require"
+	}
+	config, err := pgxpool.ParseConfig(fmt.Sprintf(
+		"host=%s port=%s user=%s dbname=%s sslmode=%s",
+		host, port, user, name, sslMode,
+	))
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	// 新しい接続を作る度にパスワードを取得する(IAM認証トークンの期限切れ対策)
+	config.BeforeConnect = func(ctx context.Context, cc *pgx.ConnConfig) error {
+		password, err := credentials.Password(ctx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		cc.Password = password
+		return nil
+	}
+	config.ConnConfig.Tracer = &pgxTracer{}
+
+	pool, err := pgxpool.NewWithConfig(context.Background(), config)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return stdlib.OpenDBFromPool(pool), pool, nil
+}
+
+var pgxAcquireDuration, _ = meter.Float64Histogram(
+	"blog.db.pool.acquire_duration",
+	metric.WithDescription("pgxpoolから接続を取得するまでの待ち時間"),
+	metric.WithUnit("s"),
+)
+
+type pgxTraceStartKey struct{}
+
+// pgxTracer はpgxのフックで、新しいスパンは作らずにdbExtが作ったスパンへイベントを記録する
+type pgxTracer struct{}
+
+var (
+	_ pgx.QueryTracer       = (*pgxTracer)(nil)
+	_ pgx.PrepareTracer     = (*pgxTracer)(nil)
+	_ pgx.ConnectTracer     = (*pgxTracer)(nil)
+	_ pgxpool.AcquireTracer = (*pgxTracer)(nil)
+)
+
+func startedAt(ctx context.Context) time.Time {
+	t, _ := ctx.Value(pgxTraceStartKey{}).(time.Time)
+	return t
+}
+
+func (t *pgxTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, pgxTraceStartKey{}, time.Now())
+}
+
+func (t *pgxTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("pgx.query", trace.WithAttributes(
+		attribute.String("pgx.command_tag", data.CommandTag.String()),
+		attribute.Int64("pgx.rows_affected", data.CommandTag.RowsAffected()),
+		attribute.Float64("pgx.duration_ms", float64(time.Since(startedAt(ctx)).Microseconds())/1000),
+	))
+	if data.Err != nil {
+		span.RecordError(data.Err)
+	}
+}
+
+func (t *pgxTracer) TracePrepareStart(ctx context.Context, _ *pgx.Conn, _ pgx.TracePrepareStartData) context.Context {
+	return context.WithValue(ctx, pgxTraceStartKey{}, time.Now())
+}
+
+func (t *pgxTracer) TracePrepareEnd(ctx context.Context, _ *pgx.Conn, data pgx.TracePrepareEndData) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("pgx.prepare", trace.WithAttributes(
+		attribute.Bool("pgx.already_prepared", data.AlreadyPrepared),
+		attribute.Float64("pgx.duration_ms", float64(time.Since(startedAt(ctx)).Microseconds())/1000),
+	))
+	if data.Err != nil {
+		span.RecordError(data.Err)
+	}
+}
+
+func (t *pgxTracer) TraceAcquireStart(ctx context.Context, _ *pgxpool.Pool, _ pgxpool.TraceAcquireStartData) context.Context {
+	return context.WithValue(ctx, pgxTraceStartKey{}, time.Now())
+}
+
+func (t *pgxTracer) TraceAcquireEnd(ctx context.Context, _ *pgxpool.Pool, data pgxpool.TraceAcquireEndData) {
+	wait := time.Since(startedAt(ctx))
+	pgxAcquireDuration.Record(ctx, wait.Seconds())
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("pgx.acquire", trace.WithAttributes(
+		attribute.Float64("pgx.duration_ms", float64(wait.Microseconds())/1000),
+	))
+	if data.Err != nil {
+		span.RecordError(data.Err)
+	}
+}
+
+func (t *pgxTracer) TraceConnectStart(ctx context.Context, _ pgx.TraceConnectStartData) context.Context {
+	return context.WithValue(ctx, pgxTraceStartKey{}, time.Now())
+}
+
+func (t *pgxTracer) TraceConnectEnd(ctx context.Context, data pgx.TraceConnectEndData) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("pgx.connect", trace.WithAttributes(
+		attribute.Float64("pgx.duration_ms", float64(time.Since(startedAt(ctx)).Microseconds())/1000),
+	))
+	if data.Err != nil {
+		span.RecordError(data.Err)
+	}
+}
+
+// registerPoolMetrics は接続プールの統計情報をメトリクスとして定期的に記録する
+// pgxの場合はpgxpoolの、lib/pqの場合はdatabase/sqlの統計情報を使う
+// dbExt毎にコールバックを登録するため、同じ接続先に複数のdbExtを作る場合は dbConfig.Role で区別する
+func registerPoolMetrics(e *dbExt) (metric.Registration, error) {
+	acquired, err := meter.Int64ObservableGauge("blog.db.pool.acquired_conns",
+		metric.WithDescription("利用中の接続数"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	idle, err := meter.Int64ObservableGauge("blog.db.pool.idle_conns",
+		metric.WithDescription("アイドル状態の接続数"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	total, err := meter.Int64ObservableGauge("blog.db.pool.total_conns",
+		metric.WithDescription("接続数"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	waitCount, err := meter.Int64ObservableCounter("blog.db.pool.wait_count",
+		metric.WithDescription("空き接続が無く待たされた回数"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	waitDuration, err := meter.Float64ObservableCounter("blog.db.pool.wait_duration",
+		metric.WithDescription("接続の取得を待った時間の合計"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	registration, err := meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		for db, info := range e.pools {
+			pool := dbPoolWriter
+			for i, reader := range e.readers {
+				if reader == db {
+					pool = fmt.Sprintf("reader-%d", i)
+				}
+			}
+			attrs := metric.WithAttributes(
+				attribute.String("db_pool", pool),
+				attribute.String("db_role", e.role),
+				attribute.String("db_driver", info.driver),
+			)
+			if info.pgxPool != nil {
+				stat := info.pgxPool.Stat()
+				o.ObserveInt64(acquired, int64(stat.AcquiredConns()), attrs)
+				o.ObserveInt64(idle, int64(stat.IdleConns()), attrs)
+				o.ObserveInt64(total, int64(stat.TotalConns()), attrs)
+				// pgxpoolの取得時間の合計には待たずに取得できた分も含まれる
+				o.ObserveInt64(waitCount, stat.EmptyAcquireCount(), attrs)
+				o.ObserveFloat64(waitDuration, stat.AcquireDuration().Seconds(), attrs)
+				continue
+			}
+			stats := db.Stats()
+			o.ObserveInt64(acquired, int64(stats.InUse), attrs)
+			o.ObserveInt64(idle, int64(stats.Idle), attrs)
+			o.ObserveInt64(total, int64(stats.OpenConnections), attrs)
+			o.ObserveInt64(waitCount, stats.WaitCount, attrs)
+			o.ObserveFloat64(waitDuration, stats.WaitDuration.Seconds(), attrs)
+		}
+		return nil
+	}, acquired, idle, total, waitCount, waitDuration)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return registration, nil
+}
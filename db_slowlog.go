@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// slowQueryLog は閾値を超えたクエリを otelslog の logger に出力する
+// 負荷試験でコレクターに大量に送らないように、サンプリングとレート制限をかける
+type slowQueryLog struct {
+	threshold  time.Duration
+	sampleRate float64 // 閾値を超えたクエリのうち出力する割合(0〜1)
+	limiter    *rate.Limiter
+	// suppressed はサンプリングやレート制限で出力しなかった件数(次に出力するログに載せる)
+	suppressed atomic.Int64
+}
+
+// newSlowQueryLogFromEnv は APP_SLOW_QUERY_THRESHOLD が指定されていればスロークエリログを返す(未指定の場合はnil)
+// APP_SLOW_QUERY_SAMPLE_RATE で出力する割合、APP_SLOW_QUERY_MAX_PER_SECOND で1秒あたりの上限を指定する
+func newSlowQueryLogFromEnv() (*slowQueryLog, error) {
+	v := os.Getenv("APP_SLOW_QUERY_THRESHOLD")
+	if v == "" {
+		return nil, nil
+	}
+	threshold, err := time.ParseDuration(v)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sampleRate := 1.0
+	if v := os.Getenv("APP_SLOW_QUERY_SAMPLE_RATE"); v != "" {
+		if sampleRate, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	maxPerSecond := 10.0
+	if v := os.Getenv("APP_SLOW_QUERY_MAX_PER_SECOND"); v != "" {
+		if maxPerSecond, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return newSlowQueryLog(threshold, sampleRate, maxPerSecond), nil
+}
+
+func newSlowQueryLog(threshold time.Duration, sampleRate, maxPerSecond float64) *slowQueryLog {
+	return &slowQueryLog{
+		threshold:  threshold,
+		sampleRate: sampleRate,
+		limiter:    rate.NewLimiter(rate.Limit(maxPerSecond), max(1, int(maxPerSecond))),
+	}
+}
+
+// slowQuery はスロークエリログの1件分
+type slowQuery struct {
+	method       string // dbExtのメソッド名 ex) QueryContext
+	query        string
+	args         map[string]any // 伏せ字を適用済みの引数
+	duration     time.Duration
+	rowsAffected int64 // 不明な場合は-1
+	err          error
+}
+
+// allow は閾値を超えていて、サンプリングとレート制限を通過した場合にtrueを返す
+func (l *slowQueryLog) allow(duration time.Duration) bool {
+	if duration < l.threshold {
+		return false
+	}
+	if (l.sampleRate < 1 && rand.Float64() >= l.sampleRate) || !l.limiter.Allow() {
+		l.suppressed.Add(1)
+		return false
+	}
+	return true
+}
+
+func (l *slowQueryLog) log(ctx context.Context, q *slowQuery) {
+	attrs := []slog.Attr{
+		slog.String("method", q.method),
+		slog.String("db.operation.name", operationName(q.query)),
+		slog.String("db.query.text", normalizeQuery(q.query)),
+		slog.Float64("duration_ms", float64(q.duration.Microseconds())/1000),
+		slog.Int64("rows_affected", q.rowsAffected),
+		slog.Int64("suppressed", l.suppressed.Swap(0)),
+	}
+	for k, v := range q.args {
+		attrs = append(attrs, slog.Any("db.query.args."+k, v))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+	}
+	if q.err != nil {
+		attrs = append(attrs, slog.String("error", q.err.Error()))
+	}
+	logger.LogAttrs(ctx, slog.LevelWarn, "スロークエリ", attrs...)
+}
+
+var (
+	queryWhitespaceRegexp = regexp.MustCompile(`\s+`)
+	queryStringRegexp     = regexp.MustCompile(`'(?:[^']|'')*'`)
+	queryNumberRegexp     = regexp.MustCompile(`([^$\w.])\d+(?:\.\d+)?\b`)
+)
+
+// normalizeQuery はクエリの空白をまとめ、リテラルを ? に置き換えて同じ形のクエリを集計しやすくする
+func normalizeQuery(query string) string {
+	query = queryStringRegexp.ReplaceAllString(query, "?")
+	query = queryNumberRegexp.ReplaceAllString(query, "${1}?")
+	return strings.TrimSpace(queryWhitespaceRegexp.ReplaceAllString(query, " "))
+}
+
+// observeQuery はクエリの所要時間を計測してリクエストの文の数に加え、閾値を超えていればスロークエリログに出力する
+// 返した関数はクエリの完了後に呼び出す
+func (e *dbExt) observeQuery(ctx context.Context, method, query string, args []any) func(rowsAffected int64, err error) {
+	stats := queryStatsFromContext(ctx)
+	if e.slowLog == nil && stats == nil {
+		return func(int64, error) {}
+	}
+	start := time.Now()
+	return func(rowsAffected int64, err error) {
+		duration := time.Since(start)
+		stats.addQuery(query, duration)
+		if e.slowLog == nil || !e.slowLog.allow(duration) {
+			return
+		}
+		redactor := e.redactor
+		if redactor == nil {
+			redactor = defaultArgRedactor
+		}
+		e.slowLog.log(ctx, &slowQuery{
+			method:       method,
+			query:        query,
+			args:         redactor.redact(query, args),
+			duration:     duration,
+			rowsAffected: rowsAffected,
+			err:          err,
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	stmtCacheHitCounter, _ = meter.Int64Counter(
+		"blog.db.stmt_cache.hits",
+		metric.WithDescription("プリペアドステートメントキャッシュのヒット数"),
+	)
+	stmtCacheMissCounter, _ = meter.Int64Counter(
+		"blog.db.stmt_cache.misses",
+		metric.WithDescription("プリペアドステートメントキャッシュのミス数"),
+	)
+	stmtCacheEvictionCounter, _ = meter.Int64Counter(
+		"blog.db.stmt_cache.evictions",
+		metric.WithDescription("プリペアドステートメントキャッシュから破棄した数"),
+	)
+)
+
+// stmtCache はライターの接続プールで準備したステートメントをSQL文をキーに保持するLRUキャッシュ
+// トランザクションでは tx.StmtContext で紐づけて使う
+// database/sql はステートメントを接続毎に準備し直すため、接続が切れた場合も次の利用時に別の接続で準備される
+type stmtCache struct {
+	db       *sql.DB
+	capacity int
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	// pending はバックグラウンドで準備中のSQL文
+	pending map[string]struct{}
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+type stmtCacheEntry struct {
+	query string
+	stmt  *sql.Stmt
+}
+
+func newStmtCache(db *sql.DB, capacity int) *stmtCache {
+	return &stmtCache{
+		db:       db,
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		pending:  make(map[string]struct{}),
+	}
+}
+
+// get はキャッシュ済みのステートメントを返す
+// キャッシュに無い場合はnilを返し、バックグラウンドで準備してキャッシュする
+// ミスした呼び出し元はトランザクションの接続で準備する(ここで同期的に準備すると別の接続と合わせて2回準備することになる)
+func (c *stmtCache) get(ctx context.Context, query string) (*sql.Stmt, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[query]; ok {
+		c.ll.MoveToFront(el)
+		stmtCacheHitCounter.Add(ctx, 1)
+		return el.Value.(*stmtCacheEntry).stmt, true
+	}
+	stmtCacheMissCounter.Add(ctx, 1)
+
+	if _, ok := c.pending[query]; ok || c.closed {
+		return nil, false
+	}
+	c.pending[query] = struct{}{}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		if err := c.prepare(context.WithoutCancel(ctx), query); err != nil {
+			log.Printf("ステートメントの準備に失敗しました。: %+v\n", err)
+		}
+	}()
+	return nil, false
+}
+
+// prepare はステートメントを準備してキャッシュする
+func (c *stmtCache) prepare(ctx context.Context, query string) error {
+	stmt, err := c.db.PrepareContext(ctx, query)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, query)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, ok := c.items[query]; ok || c.closed {
+		return errors.WithStack(stmt.Close())
+	}
+	c.items[query] = c.ll.PushFront(&stmtCacheEntry{query: query, stmt: stmt})
+	for c.ll.Len() > c.capacity {
+		c.removeElementLocked(ctx, c.ll.Back())
+	}
+	return nil
+}
+
+// invalidate はステートメントをキャッシュから破棄する
+func (c *stmtCache) invalidate(ctx context.Context, query string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[query]; ok {
+		c.removeElementLocked(ctx, el)
+	}
+}
+
+func (c *stmtCache) removeElementLocked(ctx context.Context, el *list.Element) {
+	entry := el.Value.(*stmtCacheEntry)
+	c.ll.Remove(el)
+	delete(c.items, entry.query)
+	// 利用中の接続があれば database/sql が解放時に閉じる
+	_ = entry.stmt.Close()
+	stmtCacheEvictionCounter.Add(ctx, 1)
+}
+
+// Close は準備中のステートメントを待ってから、キャッシュしている全てのステートメントを閉じる
+func (c *stmtCache) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for _, el := range c.items {
+		err = errors.Join(err, el.Value.(*stmtCacheEntry).stmt.Close())
+	}
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	return errors.WithStack(err)
+}
+
+// isStmtInvalidated はキャッシュしたステートメントが使えなくなったことを示すエラーかどうかを返す
+func isStmtInvalidated(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	code, message, ok := sqlState(err)
+	if !ok {
+		return false
+	}
+	switch code {
+	case "26000": // invalid_sql_statement_name (prepared statement does not exist)
+		return true
+	case "0A000": // feature_not_supported (cached plan must not change result type)
+		return strings.Contains(message, "cached plan")
+	}
+	class, _ := classifyTxError(err)
+	return class == txErrorClassDSQLSchemaChanged
+}
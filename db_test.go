@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/cockroachdb/errors"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_classifyTxError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		class     txErrorClass
+		retryable bool
+	}{
+		{
+			name:      "シリアライズ失敗",
+			err:       errors.WithStack(&pq.Error{Code: "40001", Message: "could not serialize access due to concurrent update"}),
+			class:     txErrorClassSerializationFailure,
+			retryable: true,
+		},
+		{
+			name:      "デッドロック",
+			err:       errors.WithStack(&pq.Error{Code: "40P01", Message: "deadlock detected"}),
+			class:     txErrorClassDeadlock,
+			retryable: true,
+		},
+		{
+			name:      "DSQLのデータ競合",
+			err:       errors.WithStack(&pq.Error{Code: "40001", Message: "change conflicts with another transaction, please retry: (OC000)"}),
+			class:     txErrorClassDSQLConflict,
+			retryable: true,
+		},
+		{
+			name:      "DSQLのスキーマ変更",
+			err:       errors.WithStack(&pq.Error{Code: "40001", Message: "schema has been updated by another transaction, please retry: (OC001)"}),
+			class:     txErrorClassDSQLSchemaChanged,
+			retryable: true,
+		},
+		{
+			name:      "一意制約違反",
+			err:       errors.WithStack(&pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"}),
+			retryable: false,
+		},
+		{
+			name:      "HTTPエラー",
+			err:       errors.WithStack(echo.NewHTTPError(404, "Not Found")),
+			retryable: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class, retryable := classifyTxError(tt.err)
+			require.Equal(t, tt.class, class)
+			require.Equal(t, tt.retryable, retryable)
+		})
+	}
+}
+
+// newTestDatabase はローカルのPostgresにテスト用のデータベースを作成して接続する
+// TEST_DB=postgres でない場合はスキップする
+func newTestDatabase(t *testing.T, name string) *sql.DB {
+	t.Helper()
+	if os.Getenv("TEST_DB") != "postgres" {
+		t.Skip("TEST_DB=postgres の場合のみ実行する")
+	}
+	ctx := context.Background()
+
+	admin, err := newConnection("127.0.0.1", "", "postgres", "postgres", "", "disable")
+	require.NoError(t, err)
+	defer admin.Close()
+	_, err = admin.ExecContext(ctx, "DROP DATABASE IF EXISTS "+name)
+	require.NoError(t, err)
+	_, err = admin.ExecContext(ctx, "CREATE DATABASE "+name)
+	require.NoError(t, err)
+
+	conn, err := newConnection("127.0.0.1", "", "postgres", "postgres", name, "disable")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+func Test_dbExt_routing(t *testing.T) {
+	ctx := context.Background()
+
+	// ライターとリーダーを別のデータベースにして、どちらに振り分けられたかを行数で判別する
+	writer := newTestDatabase(t, "blog_test_writer")
+	reader := newTestDatabase(t, "blog_test_reader")
+	for _, conn := range []*sql.DB{writer, reader} {
+		_, err := conn.ExecContext(ctx, "CREATE TABLE routing_test (id varchar NOT NULL, PRIMARY KEY (id))")
+		require.NoError(t, err)
+	}
+	db := &dbExt{
+		db:        writer,
+		readers:   []*sql.DB{reader},
+		txOptions: []txOption{withoutRetry()},
+	}
+
+	/* 書き込みはライター */
+	require.NoError(t, db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		stmt, err := tx.PrepareContext(ctx, "INSERT INTO routing_test (id) VALUES ($1)")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer stmt.Close()
+		if _, err := stmt.ExecContext(ctx, "1"); err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	}))
+
+	/* トランザクション外の読み込みはリーダー */
+	var count int
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT count(*) FROM routing_test").Scan(&count))
+	require.Equal(t, 0, count)
+
+	/* read-your-writesはライター */
+	require.NoError(t, db.QueryRowContext(withReadYourWrites(ctx), "SELECT count(*) FROM routing_test").Scan(&count))
+	require.Equal(t, 1, count)
+
+	/* トランザクション内の読み込みはライター */
+	require.NoError(t, db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		return errors.WithStack(tx.QueryRowContext(ctx, "SELECT count(*) FROM routing_test").Scan(&count))
+	}))
+	require.Equal(t, 1, count)
+}
+
+func Test_argRedactor_redact(t *testing.T) {
+	createdAt := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &argRedactor{
+		denyColumns: defaultArgRedactor.denyColumns,
+		denyValues:  defaultArgRedactor.denyValues,
+		maxLength:   8,
+	}
+
+	/* 列名で伏せる */
+	require.Equal(t, map[string]any{
+		"arg0": "id1",
+		"arg1": "name1",
+		"arg2": redactedValue,
+		"arg3": redactedValue,
+		"arg4": createdAt,
+		"arg5": nil,
+	}, r.redact(
+		"INSERT INTO users (id, name, email, password_hash, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		[]any{"id1", "name1", "a@email.com", "$2a$10$abcdefghijklmnopqrstuv", createdAt, nil},
+	))
+	require.Equal(t, map[string]any{
+		"arg0": redactedValue,
+	}, r.redact("SELECT id FROM users WHERE email = $1", []any{"a"}))
+
+	/* 列名が分からなくても値で伏せる */
+	require.Equal(t, map[string]any{
+		"arg0": redactedValue,
+		"arg1": redactedValue,
+	}, r.redact("SELECT $1, $2", []any{"a@email.com", []byte("$2a$10$abcdefghijklmnopqrstuv")}))
+
+	/* 長い文字列は切り詰める */
+	require.Equal(t, map[string]any{
+		"arg0": "12345678...",
+		"arg1": "あい...",
+		"arg2": int64(1),
+	}, r.redact("UPDATE articles SET title = $1, body = $2 WHERE id = $3", []any{"123456789", "あいう", int64(1)}))
+}
+
+func Test_stmtCache(t *testing.T) {
+	ctx := context.Background()
+	c := newStmtCache(newTestDatabase(t, "blog_test_stmt_cache"), 1)
+	defer c.Close()
+
+	// ミスした場合はバックグラウンドで準備するので、キャッシュされるまで待つ
+	get := func(query string) bool {
+		stmt, hit := c.get(ctx, query)
+		require.Equal(t, hit, stmt != nil)
+		c.wg.Wait()
+		return hit
+	}
+	require.False(t, get("SELECT 1"))
+	require.True(t, get("SELECT 1"))
+
+	/* 容量を超えると古いものから破棄する */
+	require.False(t, get("SELECT 2"))
+	require.False(t, get("SELECT 1"))
+
+	/* 無効になったものは破棄する */
+	c.invalidate(ctx, "SELECT 1")
+	require.False(t, get("SELECT 1"))
+
+	require.True(t, isStmtInvalidated(errors.WithStack(&pq.Error{Code: "26000", Message: `prepared statement "1" does not exist`})))
+	require.False(t, isStmtInvalidated(errors.WithStack(&pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"})))
+}
+
+func Test_normalizeQuery(t *testing.T) {
+	require.Equal(t,
+		"SELECT a.id, ? FROM articles a WHERE a.id > $1 AND a.version = ? LIMIT $2",
+		normalizeQuery("SELECT a.id, '' FROM articles a\n\tWHERE a.id > $1 AND a.version = 10\n  LIMIT $2"))
+	require.Equal(t,
+		"UPDATE users SET name = ? WHERE id = $1",
+		normalizeQuery("UPDATE users SET name = 'it''s' WHERE id = $1"))
+}
+
+func Test_slowQueryLog_allow(t *testing.T) {
+	/* 閾値未満は出力しない */
+	l := newSlowQueryLog(100*time.Millisecond, 1, 2)
+	require.False(t, l.allow(99*time.Millisecond))
+	require.Equal(t, int64(0), l.suppressed.Load())
+
+	/* レート制限を超えた分は抑制した件数として数える */
+	require.True(t, l.allow(100*time.Millisecond))
+	require.True(t, l.allow(time.Second))
+	require.False(t, l.allow(time.Second))
+	require.Equal(t, int64(1), l.suppressed.Load())
+
+	/* サンプリング率が0なら出力しない */
+	l = newSlowQueryLog(0, 0, 100)
+	for i := 0; i < 10; i++ {
+		require.False(t, l.allow(time.Second))
+	}
+	require.Equal(t, int64(10), l.suppressed.Load())
+}
+
+func Test_dbExt_afterCommit(t *testing.T) {
+	ctx := context.Background()
+	db := &dbExt{db: newTestDatabase(t, "blog_test_after_commit")}
+
+	/* リトライされた試行の関数は実行せず、コミットした試行の関数だけを1回実行する */
+	called := make([]int, 0)
+	attempt := 0
+	require.NoError(t, db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		attempt++
+		n := attempt
+		tx.AfterCommit(func(ctx context.Context) error {
+			called = append(called, n)
+			return nil
+		})
+		if attempt < 3 {
+			return errors.WithStack(&pq.Error{Code: "40001", Message: "could not serialize access due to concurrent update"})
+		}
+		return nil
+	}, withBackOff(func() backoff.BackOff {
+		return backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 3)
+	})))
+	require.Equal(t, []int{3}, called)
+
+	/* ロールバックした場合は実行しない */
+	called = called[:0]
+	require.Error(t, db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		tx.AfterCommit(func(ctx context.Context) error {
+			called = append(called, 1)
+			return nil
+		})
+		return errors.New("rollback")
+	}))
+	require.Empty(t, called)
+}
+
+func Test_txOptions(t *testing.T) {
+	ctx := context.Background()
+	deadlineCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	resolve := func(opts ...txOption) *txOptions {
+		o := &txOptions{name: txNameUnnamed}
+		for _, opt := range opts {
+			opt(o)
+		}
+		return o
+	}
+
+	/* 分離レベルと読み取り専用 */
+	o := resolve()
+	require.Equal(t, sql.LevelDefault, o.isolation)
+	require.False(t, o.readOnly)
+	o = resolve(withIsolationLevel(sql.LevelRepeatableRead), withReadOnly())
+	require.Equal(t, sql.LevelRepeatableRead, o.isolation)
+	require.True(t, o.readOnly)
+
+	/* デフォルトのポリシーはデッドラインがある場合だけ経過時間の上限を外す */
+	b, ok := resolve().backOff(ctx).(*backoff.ExponentialBackOff)
+	require.True(t, ok)
+	require.Equal(t, 60*time.Second, b.MaxElapsedTime)
+	b, ok = resolve().backOff(deadlineCtx).(*backoff.ExponentialBackOff)
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), b.MaxElapsedTime)
+
+	/* withBackOffで指定したポリシーはデッドラインがあっても変更しない */
+	custom := resolve(withBackOff(func() backoff.BackOff {
+		b := backoff.NewExponentialBackOff()
+		b.MaxElapsedTime = 5 * time.Second
+		return b
+	}))
+	b, ok = custom.backOff(deadlineCtx).(*backoff.ExponentialBackOff)
+	require.True(t, ok)
+	require.Equal(t, 5*time.Second, b.MaxElapsedTime)
+	_, ok = resolve(withoutRetry()).backOff(deadlineCtx).(*backoff.StopBackOff)
+	require.True(t, ok)
+}
+
+func Test_dbExt_txOptions(t *testing.T) {
+	ctx := context.Background()
+	db := &dbExt{db: newTestDatabase(t, "blog_test_tx_options")}
+	_, err := db.db.ExecContext(ctx, "CREATE TABLE tx_options_test (id varchar NOT NULL, PRIMARY KEY (id))")
+	require.NoError(t, err)
+	serializationFailure := &pq.Error{Code: "40001", Message: "could not serialize access due to concurrent update"}
+
+	/* 分離レベル */
+	var isolation string
+	require.NoError(t, db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		return errors.WithStack(tx.tx.QueryRowContext(ctx, "SHOW transaction_isolation").Scan(&isolation))
+	}, withIsolationLevel(sql.LevelRepeatableRead)))
+	require.Equal(t, "repeatable read", isolation)
+
+	/* 読み取り専用トランザクションでの書き込みはリトライせずに失敗する */
+	attempt := 0
+	err = db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		attempt++
+		_, err := tx.tx.ExecContext(ctx, "INSERT INTO tx_options_test (id) VALUES ('read-only')")
+		return errors.WithStack(err)
+	}, withReadOnly())
+	code, _, ok := sqlState(err)
+	require.True(t, ok)
+	require.Equal(t, "25006", code)
+	require.Equal(t, 1, attempt)
+
+	/* withBackOffのポリシーでリトライする */
+	attempt = 0
+	err = db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		attempt++
+		return errors.WithStack(serializationFailure)
+	}, withBackOff(func() backoff.BackOff {
+		return backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 2)
+	}))
+	require.Error(t, err)
+	require.Equal(t, 3, attempt)
+
+	/* デッドラインを過ぎたらデフォルトのポリシーでも待たずに諦める */
+	deadlineCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	attempt = 0
+	start := time.Now()
+	err = db.Transaction(deadlineCtx, func(ctx context.Context, tx *txExt) error {
+		attempt++
+		return errors.WithStack(serializationFailure)
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, attempt)
+	// デフォルトの初回の待ち時間(2s±50%)より前に戻る
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func Test_memoryStore_afterCommit(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	userRepo := &memoryUserRepository{store: store}
+
+	/* 登録順に実行し、エラーになっても後続の関数は実行する */
+	called := make([]int, 0)
+	require.NoError(t, store.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		for i := 0; i < 3; i++ {
+			tx.AfterCommit(func(ctx context.Context) error {
+				called = append(called, i)
+				// ロックを解放してから実行するので、コミットした内容を読める
+				if _, err := userRepo.FindByEmail(ctx, "a@email.com"); err != nil {
+					return errors.WithStack(err)
+				}
+				return errors.New("失敗しても他の関数は実行する")
+			})
+		}
+		return errors.WithStack(userRepo.Insert(ctx, tx, &User{ID: "user-1", Email: "a@email.com"}))
+	}))
+	require.Equal(t, []int{0, 1, 2}, called)
+
+	/* ロールバックした場合は実行しない */
+	called = called[:0]
+	require.Error(t, store.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		tx.AfterCommit(func(ctx context.Context) error {
+			called = append(called, 1)
+			return nil
+		})
+		return errors.New("rollback")
+	}))
+	require.Empty(t, called)
+}
+
+func Test_dbExt_savepoint(t *testing.T) {
+	ctx := context.Background()
+
+	/* セーブポイントを使えないバックエンドではSQLを実行せずにエラーを返す */
+	dsql := &txExt{dbExt: &dbExt{dialect: dialectDSQL}}
+	called := false
+	err := dsql.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		called = true
+		return nil
+	})
+	require.ErrorIs(t, err, errSavepointUnsupported)
+	require.False(t, called)
+
+	db := &dbExt{db: newTestDatabase(t, "blog_test_savepoint")}
+	_, err = db.db.ExecContext(ctx, "CREATE TABLE savepoint_test (id varchar NOT NULL, PRIMARY KEY (id))")
+	require.NoError(t, err)
+
+	/* 内側のエラーはセーブポイントまでロールバックし、外側の変更はコミットする */
+	hooks := make([]string, 0)
+	require.NoError(t, db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		if _, err := tx.tx.ExecContext(ctx, "INSERT INTO savepoint_test (id) VALUES ('outer')"); err != nil {
+			return errors.WithStack(err)
+		}
+		err := tx.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+			tx.AfterCommit(func(ctx context.Context) error {
+				hooks = append(hooks, "rollback")
+				return nil
+			})
+			if _, err := tx.tx.ExecContext(ctx, "INSERT INTO savepoint_test (id) VALUES ('rollback')"); err != nil {
+				return errors.WithStack(err)
+			}
+			// 一意制約違反でもセーブポイントまで戻せば外側のトランザクションを続けられる
+			_, err := tx.tx.ExecContext(ctx, "INSERT INTO savepoint_test (id) VALUES ('outer')")
+			return errors.WithStack(err)
+		})
+		require.Error(t, err)
+		return errors.WithStack(tx.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+			tx.AfterCommit(func(ctx context.Context) error {
+				hooks = append(hooks, "release")
+				return nil
+			})
+			_, err := tx.tx.ExecContext(ctx, "INSERT INTO savepoint_test (id) VALUES ('release')")
+			return errors.WithStack(err)
+		}))
+	}))
+	require.Equal(t, []string{"release"}, hooks)
+
+	rows, err := db.db.QueryContext(ctx, "SELECT id FROM savepoint_test ORDER BY id")
+	require.NoError(t, err)
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		require.NoError(t, rows.Scan(&id))
+		ids = append(ids, id)
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, []string{"outer", "release"}, ids)
+}
+
+func Test_memoryStore_savepoint(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	userRepo := &memoryUserRepository{store: store}
+
+	/* 内側のエラーは内側の変更とコミット後の関数だけを捨てる */
+	hooks := make([]string, 0)
+	require.NoError(t, store.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		if err := userRepo.Insert(ctx, tx, &User{ID: "user-1", Email: "a@email.com"}); err != nil {
+			return errors.WithStack(err)
+		}
+		err := tx.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+			tx.AfterCommit(func(ctx context.Context) error {
+				hooks = append(hooks, "rollback")
+				return nil
+			})
+			if err := userRepo.Insert(ctx, tx, &User{ID: "user-2", Email: "b@email.com"}); err != nil {
+				return errors.WithStack(err)
+			}
+			return errors.New("rollback")
+		})
+		require.Error(t, err)
+		return errors.WithStack(tx.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+			tx.AfterCommit(func(ctx context.Context) error {
+				hooks = append(hooks, "release")
+				return nil
+			})
+			return errors.WithStack(userRepo.Insert(ctx, tx, &User{ID: "user-3", Email: "c@email.com"}))
+		}))
+	}))
+	require.Equal(t, []string{"release"}, hooks)
+
+	for email, want := range map[string]bool{"a@email.com": true, "b@email.com": false, "c@email.com": true} {
+		_, err := userRepo.FindByEmail(ctx, email)
+		require.Equal(t, want, err == nil, email)
+	}
+}
@@ -3,10 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
-	"math/rand"
 	"net/http"
-	"os"
-	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/labstack/echo/v4"
@@ -17,6 +14,14 @@ import (
 
 type contextKey struct{}
 
+// headerReadYourWrites が"true"のリクエストはリーダーではなくライターから読み込む
+const headerReadYourWrites = "X-Read-Your-Writes"
+
+const (
+	headerETag    = "ETag"
+	headerIfMatch = "If-Match"
+)
+
 type Context struct {
 	User *User
 }
@@ -30,19 +35,36 @@ func Extract(ctx context.Context) *Context {
 }
 
 func newHTTPHandler() (http.Handler, error) {
-	conn, err := newConnection(
-		os.Getenv("DB_HOST"), os.Getenv("DB_PORT"), os.Getenv("DB_USER"),
-		os.Getenv("DB_PASS"), os.Getenv("DB_NAME"), os.Getenv("DB_SSL"),
-	)
+	db, err := newDBExt(dbConfigFromEnv())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	idGen, err := newIDGeneratorFromEnv()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	h := &handler{
-		db: &dbExt{conn},
-		randUtil: &randUtilImpl{
-			Rand: rand.New(rand.NewSource(time.Now().UnixNano())),
-		},
-		timer: &timerImpl{},
+	counterShards, err := favoriteCounterShardsFromEnvPrefix("")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	h := newSQLHandler(db, idGen, &timerImpl{}, counterShards)
+	if h.idempotencyTTL, err = idempotencyTTLFromEnv(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if h.idempotencyProcessingTimeout, err = idempotencyProcessingTimeoutFromEnv(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(outboxSinksFromEnv()) > 0 {
+		h.outboxRepo = &sqlOutboxRepository{db: db}
+	}
+	if h.queryBudget, err = queryBudgetFromEnv(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if h.articleBatchMax, err = articleBatchMaxFromEnv(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if h.favoriteDuplicates, err = favoriteDuplicateModeFromEnv(); err != nil {
+		return nil, errors.WithStack(err)
 	}
 
 	return setupEcho(h), nil
@@ -51,9 +73,27 @@ func newHTTPHandler() (http.Handler, error) {
 func setupEcho(h *handler) *echo.Echo {
 	e := echo.New()
 	e.HideBanner = true
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		// errors.WithStackでラップされたecho.HTTPErrorのステータスコードを維持する
+		var he *echo.HTTPError
+		if errors.As(err, &he) {
+			err = he
+		}
+		e.DefaultHTTPErrorHandler(err, c)
+	}
 	e.Use(otelecho.Middleware("")) // 空にするとリクエストヘッダーからホスト名が自動で設定される
 	e.Use(middleware.Recover())
 	e.Use(middleware.RequestID())
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Request().Header.Get(headerReadYourWrites) == "true" {
+				c.SetRequest(c.Request().WithContext(withReadYourWrites(c.Request().Context())))
+			}
+			return next(c)
+		}
+	})
+	// 認証のクエリも含めて数える
+	e.Use(h.countQueries)
 
 	e.Use(middleware.BasicAuth(func(email string, password string, e echo.Context) (bool, error) {
 		ctx := e.Request().Context()
@@ -61,9 +101,8 @@ func setupEcho(h *handler) *echo.Echo {
 			return true, nil
 		}
 
-		row := h.db.QueryRowContext(ctx, "SELECT id, name, email, password_hash, created_at, updated_at FROM users WHERE email = $1", email)
-		user := &User{}
-		if err := row.Scan(&user.ID, &user.Name, &user.Email, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt); err != nil {
+		user, err := h.userRepo.FindByEmail(ctx, email)
+		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				return false, nil
 			}
@@ -80,14 +119,17 @@ func setupEcho(h *handler) *echo.Echo {
 		), nil
 	}))
 
-	e.POST("/user", h.handlePostUser)
+	// Idempotency-Key は認証後のユーザー毎に保存する
+	e.POST("/user", h.handlePostUser, h.idempotency)
 	e.GET("/articles", h.handleGetArticleList)
 	e.GET("/article/:article_id", h.handleGetArticle)
-	e.POST("/article", h.handlePostArticle)
+	e.POST("/article", h.handlePostArticle, h.idempotency)
+	e.POST("/articles/batch", h.handlePostArticleBatch, h.idempotency)
 	e.PATCH("/article/:article_id", h.handlePatchArticle)
 	e.DELETE("/article/:article_id", h.handleDeleteArticle)
 	e.GET("/favorite/articles", h.handleGetFavoriteArticleList)
-	e.POST("/favorite/article/:article_id", h.handlePostFavoriteArticle)
+	e.POST("/favorite/article/:article_id", h.handlePostFavoriteArticle, h.idempotency)
+	e.DELETE("/favorite/article/:article_id", h.handleDeleteFavoriteArticle)
 
 	return e
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+
+	"github.com/cockroachdb/errors"
+)
+
+var (
+	// errFavoriteDuplicated は登録済みのお気に入りを登録しようとした
+	errFavoriteDuplicated = errors.New("既にお気に入り登録しています。")
+	// errFavoriteNotFound は登録されていないお気に入りを解除しようとした
+	errFavoriteNotFound = errors.New("お気に入り登録していません。")
+)
+
+// favoriteDuplicateMode は登録済みのお気に入りの登録と、登録されていないお気に入りの解除の扱い
+type favoriteDuplicateMode string
+
+const (
+	favoriteDuplicateConflict favoriteDuplicateMode = "conflict" // 登録は409、解除は404を返す(デフォルト)
+	favoriteDuplicateIgnore   favoriteDuplicateMode = "ignore"   // 何も変更せずに200を返す
+)
+
+// favoriteDuplicateModeFromEnv は APP_FAVORITE_DUPLICATE からお気に入りの重複の扱いを返す
+func favoriteDuplicateModeFromEnv() (favoriteDuplicateMode, error) {
+	switch mode := favoriteDuplicateMode(os.Getenv("APP_FAVORITE_DUPLICATE")); mode {
+	case "":
+		return favoriteDuplicateConflict, nil
+	case favoriteDuplicateConflict, favoriteDuplicateIgnore:
+		return mode, nil
+	default:
+		return "", errors.Newf("未対応のAPP_FAVORITE_DUPLICATEです。: %s", mode)
+	}
+}
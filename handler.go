@@ -3,18 +3,19 @@ package main
 import (
 	"context"
 	"database/sql"
+	"log"
 	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cockroachdb/errors"
-	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type randUtil interface {
-	NewString() string
 	Hit(rate, denominator int) bool
 }
 
@@ -22,10 +23,6 @@ type randUtilImpl struct {
 	*rand.Rand
 }
 
-func (r *randUtilImpl) NewString() string {
-	return uuid.NewString()
-}
-
 func (r *randUtilImpl) Hit(rate, denominator int) bool {
 	return rate > r.Intn(denominator)
 }
@@ -41,9 +38,46 @@ func (t *timerImpl) Now() time.Time {
 }
 
 type handler struct {
-	db       *dbExt
-	randUtil randUtil
-	timer    timer
+	db           transactor
+	userRepo     UserRepository
+	articleRepo  ArticleRepository
+	favoriteRepo FavoriteRepository
+	// idempotencyRepo は Idempotency-Key のレスポンスを保存する
+	idempotencyRepo IdempotencyRepository
+	idempotencyTTL  time.Duration
+	// idempotencyProcessingTimeout を過ぎても処理中のキーは次のリクエストが引き継ぐ
+	idempotencyProcessingTimeout time.Duration
+	// outboxRepo は変更イベントを書き込む(nilの場合は書き込まない)
+	outboxRepo OutboxRepository
+	// queryBudget は1リクエストで実行してよい文の数の上限(nilの場合は数えるだけ)
+	queryBudget *queryBudget
+	// articleBatchMax は POST /articles/batch で1回に作成できる記事数
+	articleBatchMax int
+	// maxRowsPerTx は1トランザクションで変更できる行数の上限(0は無制限)
+	maxRowsPerTx int
+	// favoriteDuplicates は登録済みのお気に入りの登録と、登録されていないお気に入りの解除の扱い
+	favoriteDuplicates favoriteDuplicateMode
+	idGen              idGenerator
+	timer              timer
+}
+
+// newSQLHandler はdbExtを使うリポジトリでハンドラーを作成する
+// counterShards が1以上の場合はお気に入り数にシャーディングカウンターを使う
+func newSQLHandler(db *dbExt, idGen idGenerator, timer timer, counterShards int) *handler {
+	return &handler{
+		db:                           db,
+		userRepo:                     &sqlUserRepository{db: db},
+		articleRepo:                  &sqlArticleRepository{db: db, counterShards: counterShards},
+		favoriteRepo:                 &sqlFavoriteRepository{db: db},
+		idempotencyRepo:              &sqlIdempotencyRepository{db: db},
+		idempotencyTTL:               defaultIdempotencyTTL,
+		idempotencyProcessingTimeout: defaultIdempotencyProcessingTimeout,
+		articleBatchMax:              defaultArticleBatchMax,
+		maxRowsPerTx:                 db.dialect.MaxRowsPerTransaction(),
+		favoriteDuplicates:           favoriteDuplicateConflict,
+		idGen:                        idGen,
+		timer:                        timer,
+	}
 }
 
 func (h *handler) handlePostUser(c echo.Context) error {
@@ -64,7 +98,7 @@ func (h *handler) handlePostUser(c echo.Context) error {
 		return errors.WithStack(err)
 	}
 	user := &User{
-		ID:           h.randUtil.NewString(),
+		ID:           h.idGen.NewID(),
 		Name:         req.Name,
 		Email:        req.Email,
 		PasswordHash: string(passwordHash),
@@ -73,30 +107,52 @@ func (h *handler) handlePostUser(c echo.Context) error {
 	}
 
 	if err := h.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
-		stmt, err := tx.PrepareContext(ctx, "INSERT INTO users (id, name, email, password_hash, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6)")
-		if err != nil {
-			return errors.WithStack(err)
-		}
-
-		if _, err := stmt.ExecContext(ctx, user.ID, user.Name, user.Email, user.PasswordHash, user.CreatedAt, user.UpdatedAt); err != nil {
-			return errors.WithStack(err)
-		}
-		return nil
-	}); err != nil {
+		return errors.WithStack(h.userRepo.Insert(ctx, tx, user))
+	}, withTxName("post_user")); err != nil {
 		return errors.WithStack(err)
 	}
 
 	return c.NoContent(http.StatusOK)
 }
 
+// handleGetArticleList は sort の順に記事を limit 件ずつ返す
+// 続きがある場合は next_cursor を返し、cursor に指定すると次のページを返す
 func (h *handler) handleGetArticleList(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	rows, err := h.db.QueryContext(ctx, "SELECT id, title, body, user_id, total_favorite_count, created_at, updated_at FROM articles ORDER BY created_at DESC LIMIT 100")
+	type request struct {
+		Sort   string `query:"sort"`
+		Cursor string `query:"cursor"`
+		Limit  int    `query:"limit"`
+	}
+	req := &request{}
+	if err := c.Bind(req); err != nil {
+		return errors.WithStack(err)
+	}
+	q := &articleListQuery{Limit: defaultArticleListLimit}
+	var err error
+	if q.Sort, err = parseArticleSort(req.Sort); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.Cursor != "" {
+		if q.After, err = decodeArticleCursor(req.Cursor, q.Sort); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "cursorが不正です。")
+		}
+	}
+	switch {
+	case req.Limit < 0:
+		return echo.NewHTTPError(http.StatusBadRequest, "limitは1以上を指定してください。")
+	case req.Limit > 0:
+		q.Limit = min(req.Limit, maxArticleListLimit)
+	}
+
+	// 続きがあるかを判定するために1件多く取得する
+	limit := q.Limit
+	q.Limit++
+	articles, err := h.articleRepo.List(ctx, q)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	defer rows.Close()
 
 	type responseItem struct {
 		ArticleID string `json:"article_id"`
@@ -104,15 +160,17 @@ func (h *handler) handleGetArticleList(c echo.Context) error {
 	}
 	type response struct {
 		List []*responseItem `json:"list"`
+		// NextCursor は最後のページでは返さない
+		NextCursor string `json:"next_cursor,omitempty"`
 	}
 	res := &response{
 		List: make([]*responseItem, 0),
 	}
-	for rows.Next() {
-		article := &Article{}
-		if err := rows.Scan(&article.ID, &article.Title, &article.Body, &article.UserID, &article.TotalFavoriteCount, &article.CreatedAt, &article.UpdatedAt); err != nil {
-			return errors.WithStack(err)
-		}
+	if len(articles) > limit {
+		articles = articles[:limit]
+		res.NextCursor = newArticleCursor(q.Sort, articles[len(articles)-1]).encode()
+	}
+	for _, article := range articles {
 		res.List = append(res.List, &responseItem{
 			ArticleID: article.ID,
 			Title:     article.Title,
@@ -133,18 +191,51 @@ func (h *handler) handleGetArticle(c echo.Context) error {
 		return errors.WithStack(err)
 	}
 
-	row := h.db.QueryRowContext(ctx, "SELECT id, title, body, user_id, total_favorite_count, created_at, updated_at FROM articles WHERE id = $1", req.ArticleID)
-	article := &Article{}
-	if err := row.Scan(&article.ID, &article.Title, &article.Body, &article.UserID, &article.TotalFavoriteCount, &article.CreatedAt, &article.UpdatedAt); err != nil {
+	article, err := h.articleRepo.Find(ctx, nil, req.ArticleID)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "Not Found")
 		}
 		return errors.WithStack(err)
 	}
 
+	c.Response().Header().Set(headerETag, articleETag(article))
 	return c.JSON(http.StatusOK, article)
 }
 
+// articleETag は記事のバージョンから強いETagを作る
+func articleETag(article *Article) string {
+	return `"` + strconv.FormatInt(article.Version, 10) + `"`
+}
+
+// checkIfMatch はIf-Matchヘッダーがあれば記事のETagと一致するかを確認し、一致しなければ412を返す
+func checkIfMatch(c echo.Context, article *Article) error {
+	ifMatch := c.Request().Header.Get(headerIfMatch)
+	if ifMatch == "" {
+		return nil
+	}
+	etag := articleETag(article)
+	for _, v := range strings.Split(ifMatch, ",") {
+		// 弱いETag(W/)は強い比較で一致しない
+		if v = strings.TrimSpace(v); v == "*" || v == etag {
+			return nil
+		}
+	}
+	return echo.NewHTTPError(http.StatusPreconditionFailed, "Precondition Failed")
+}
+
+// versionConflictError は読み込んでから更新するまでの間に記事が変更されていた場合のエラーを返す
+// If-Matchを指定していれば412、指定していなければ409にする
+func versionConflictError(c echo.Context, err error) error {
+	if !errors.Is(err, errArticleVersionConflict) {
+		return errors.WithStack(err)
+	}
+	if c.Request().Header.Get(headerIfMatch) != "" {
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "Precondition Failed")
+	}
+	return echo.NewHTTPError(http.StatusConflict, "Conflict")
+}
+
 func (h *handler) handlePostArticle(c echo.Context) error {
 	ctx := c.Request().Context()
 	userID := Extract(ctx).User.ID
@@ -158,28 +249,24 @@ func (h *handler) handlePostArticle(c echo.Context) error {
 		return errors.WithStack(err)
 	}
 
-	articleID := h.randUtil.NewString()
+	articleID := h.idGen.NewID()
 	article := &Article{
 		ID:                 articleID,
 		Title:              req.Title,
 		Body:               req.Body,
 		UserID:             userID,
 		TotalFavoriteCount: 0,
+		Version:            1,
 		CreatedAt:          h.timer.Now(),
 		UpdatedAt:          h.timer.Now(),
 	}
 
 	if err := h.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
-		stmt, err := tx.PrepareContext(ctx, "INSERT INTO articles (id, title, body, user_id, total_favorite_count, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)")
-		if err != nil {
+		if err := h.articleRepo.Insert(ctx, tx, article); err != nil {
 			return errors.WithStack(err)
 		}
-		defer stmt.Close()
-		if _, err := stmt.ExecContext(ctx, article.ID, article.Title, article.Body, article.UserID, article.TotalFavoriteCount, article.CreatedAt, article.UpdatedAt); err != nil {
-			return errors.WithStack(err)
-		}
-		return nil
-	}); err != nil {
+		return errors.WithStack(h.writeEvent(ctx, tx, eventArticleCreated, article.ID, article))
+	}, withTxName("post_article")); err != nil {
 		return errors.WithStack(err)
 	}
 
@@ -205,16 +292,11 @@ func (h *handler) handlePatchArticle(c echo.Context) error {
 		return errors.WithStack(err)
 	}
 
+	var article *Article
 	if err := h.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
-		article := &Article{}
-
-		stmt, err := tx.PrepareContext(ctx, "SELECT id, title, body, user_id, total_favorite_count, created_at, updated_at FROM articles WHERE id = $1")
+		var err error
+		article, err = h.articleRepo.Find(ctx, tx, req.ArticleID)
 		if err != nil {
-			return errors.WithStack(err)
-		}
-
-		row := stmt.QueryRowContext(ctx, req.ArticleID)
-		if err := row.Scan(&article.ID, &article.Title, &article.Body, &article.UserID, &article.TotalFavoriteCount, &article.CreatedAt, &article.UpdatedAt); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				return echo.NewHTTPError(http.StatusNotFound, "Not Found")
 			}
@@ -223,6 +305,9 @@ func (h *handler) handlePatchArticle(c echo.Context) error {
 		if article.UserID != userID {
 			return echo.NewHTTPError(http.StatusForbidden, "Forbidden")
 		}
+		if err := checkIfMatch(c, article); err != nil {
+			return errors.WithStack(err)
+		}
 		if req.Title != "" {
 			article.Title = req.Title
 		}
@@ -230,22 +315,45 @@ func (h *handler) handlePatchArticle(c echo.Context) error {
 			article.Body = req.Body
 		}
 		article.UpdatedAt = h.timer.Now()
-		stmt, err = tx.PrepareContext(ctx, "UPDATE articles SET title = $1, body = $2, updated_at = $3 WHERE id = $4")
-		if err != nil {
-			return errors.WithStack(err)
-		}
-		defer stmt.Close()
-		if _, err := stmt.ExecContext(ctx, article.Title, article.Body, article.UpdatedAt, article.ID); err != nil {
+		if err := h.articleRepo.Update(ctx, tx, article); err != nil {
 			return errors.WithStack(err)
 		}
-		return nil
-	}); err != nil {
-		return errors.WithStack(err)
+		return errors.WithStack(h.writeEvent(ctx, tx, eventArticleUpdated, article.ID, article))
+	}, withTxName("patch_article")); err != nil {
+		return versionConflictError(c, err)
 	}
 
+	c.Response().Header().Set(headerETag, articleETag(article))
 	return c.NoContent(http.StatusOK)
 }
 
+// favoritesPerTransaction は記事を削除した後に1トランザクションで削除するお気に入りの数(0は記事と同じトランザクションで全て削除する)
+func (h *handler) favoritesPerTransaction() int {
+	return h.maxRowsPerTx
+}
+
+// findDeletableArticle は userID が削除できる記事を返す(無ければ404、著者でなければ403、If-Matchが一致しなければ412)
+func (h *handler) findDeletableArticle(ctx context.Context, c echo.Context, tx *txExt, articleID, userID string) (*Article, error) {
+	article, err := h.articleRepo.Find(ctx, tx, articleID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "Not Found")
+		}
+		return nil, errors.WithStack(err)
+	}
+	if article.UserID != userID {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Forbidden")
+	}
+	if err := checkIfMatch(c, article); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return article, nil
+}
+
+// handleDeleteArticle は記事とそのお気に入りを削除する
+// 1トランザクションで変更できる行数に上限があるバックエンド(DSQL)では、先に記事をバージョンを条件に削除してコミットし、
+// その後にお気に入りを別のトランザクションで少しずつ削除する(途中で失敗した場合に残ったお気に入りは sweep で削除する)
+// 記事の削除が失敗した場合(404、403、412、409)はお気に入りを削除しない
 func (h *handler) handleDeleteArticle(c echo.Context) error {
 	ctx := c.Request().Context()
 	userID := Extract(ctx).User.ID
@@ -258,29 +366,45 @@ func (h *handler) handleDeleteArticle(c echo.Context) error {
 		return errors.WithStack(err)
 	}
 
+	size := h.favoritesPerTransaction()
 	if err := h.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
-		article := &Article{}
-		row := tx.QueryRowContext(ctx, "SELECT id, title, body, user_id, total_favorite_count, created_at, updated_at FROM articles WHERE id = $1", req.ArticleID)
-		if err := row.Scan(&article.ID, &article.Title, &article.Body, &article.UserID, &article.TotalFavoriteCount, &article.CreatedAt, &article.UpdatedAt); err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				return echo.NewHTTPError(http.StatusNotFound, "Not Found")
-			}
+		article, err := h.findDeletableArticle(ctx, c, tx, req.ArticleID, userID)
+		if err != nil {
 			return errors.WithStack(err)
 		}
-		if article.UserID != userID {
-			return echo.NewHTTPError(http.StatusForbidden, "Forbidden")
+		// 外部キーの無いバックエンドでもお気に入りが残らないように、上限が無ければ同じトランザクションで削除する
+		if size <= 0 {
+			if _, err := h.favoriteRepo.DeleteByArticle(ctx, tx, article.ID, 0); err != nil {
+				return errors.WithStack(err)
+			}
 		}
-		stmt, err := tx.PrepareContext(ctx, "DELETE FROM articles WHERE id = $1")
-		if err != nil {
+		if err := h.articleRepo.Delete(ctx, tx, article); err != nil {
 			return errors.WithStack(err)
 		}
-		defer stmt.Close()
-		if _, err := stmt.ExecContext(ctx, article.ID); err != nil {
-			return errors.WithStack(err)
+		return errors.WithStack(h.writeEvent(ctx, tx, eventArticleDeleted, article.ID, map[string]any{
+			"id":      article.ID,
+			"user_id": article.UserID,
+		}))
+	}, withTxName("delete_article")); err != nil {
+		return versionConflictError(c, err)
+	}
+
+	if size > 0 {
+		for {
+			deleted := 0
+			if err := h.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+				var err error
+				deleted, err = h.favoriteRepo.DeleteByArticle(ctx, tx, req.ArticleID, size)
+				return errors.WithStack(err)
+			}, withTxName("delete_article_favorites")); err != nil {
+				// 記事は削除済みなので、残ったお気に入りは孤立した行として sweep で削除する
+				log.Printf("記事のお気に入りの削除に失敗しました。: article_id=%s %+v\n", req.ArticleID, err)
+				break
+			}
+			if deleted < size {
+				break
+			}
 		}
-		return nil
-	}); err != nil {
-		return errors.WithStack(err)
 	}
 
 	return c.NoContent(http.StatusOK)
@@ -290,18 +414,13 @@ func (h *handler) handleGetFavoriteArticleList(c echo.Context) error {
 	ctx := c.Request().Context()
 	userID := Extract(ctx).User.ID
 
-	rows, err := h.db.QueryContext(ctx, "SELECT id, title, body, user_id, total_favorite_count, created_at, updated_at FROM articles WHERE id IN (SELECT article_id FROM users_articles WHERE user_id = $1) ORDER BY created_at DESC", userID)
-	if err != nil {
+	var articleList []*Article
+	if err := h.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		var err error
+		articleList, err = h.articleRepo.ListFavoritedBy(ctx, tx, userID)
+		return errors.WithStack(err)
+	}, withIsolationLevel(sql.LevelRepeatableRead), withReadOnly(), withTxName("list_favorite_articles")); err != nil {
 		return errors.WithStack(err)
-	}
-	defer rows.Close()
-	articleList := make([]*Article, 0)
-	for rows.Next() {
-		article := &Article{}
-		if err := rows.Scan(&article.ID, &article.Title, &article.Body, &article.UserID, &article.TotalFavoriteCount, &article.CreatedAt, &article.UpdatedAt); err != nil {
-			return errors.WithStack(err)
-		}
-		articleList = append(articleList, article)
 	}
 
 	type responseItem struct {
@@ -336,34 +455,87 @@ func (h *handler) handlePostFavoriteArticle(c echo.Context) error {
 	}
 
 	if err := h.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
-		row := tx.QueryRowContext(ctx, "SELECT id, title, body, user_id, total_favorite_count, created_at, updated_at FROM articles WHERE id = $1", req.ArticleID)
-		article := &Article{}
-		if err := row.Scan(&article.ID, &article.Title, &article.Body, &article.UserID, &article.TotalFavoriteCount, &article.CreatedAt, &article.UpdatedAt); err != nil {
+		article, err := h.articleRepo.Find(ctx, tx, req.ArticleID)
+		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				return echo.NewHTTPError(http.StatusNotFound, "Not Found")
 			}
 			return errors.WithStack(err)
 		}
 
-		stmt, err := tx.PrepareContext(ctx, "UPDATE articles SET total_favorite_count = $1, updated_at = $2 WHERE id = $3")
-		if err != nil {
+		userArticle := &UserArticle{
+			UserID:    userID,
+			ArticleID: req.ArticleID,
+			CreatedAt: h.timer.Now(),
+			UpdatedAt: h.timer.Now(),
+		}
+		if err := h.favoriteRepo.Insert(ctx, tx, userArticle); err != nil {
+			if isUniqueViolation(err) {
+				return errors.WithStack(errFavoriteDuplicated)
+			}
 			return errors.WithStack(err)
 		}
-		defer stmt.Close()
-		if _, err := stmt.ExecContext(ctx, article.TotalFavoriteCount+1, h.timer.Now(), article.ID); err != nil {
+		// 重複したお気に入りでカウンターの行をロックしないように、登録できてから加算する
+		if err := h.articleRepo.AddTotalFavoriteCount(ctx, tx, article.ID, 1, h.timer.Now()); err != nil {
 			return errors.WithStack(err)
 		}
+		return errors.WithStack(h.writeEvent(ctx, tx, eventArticleFavorited, article.ID, userArticle))
+	}, withTxName("post_favorite")); err != nil {
+		if errors.Is(err, errFavoriteDuplicated) {
+			if h.favoriteDuplicates == favoriteDuplicateIgnore {
+				return c.NoContent(http.StatusOK)
+			}
+			return echo.NewHTTPError(http.StatusConflict, "既にお気に入り登録しています。")
+		}
+		return errors.WithStack(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// handleDeleteFavoriteArticle はお気に入りを解除してお気に入り数を1減らす
+func (h *handler) handleDeleteFavoriteArticle(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := Extract(ctx).User.ID
 
-		stmt, err = tx.PrepareContext(ctx, "INSERT INTO users_articles (user_id, article_id, created_at, updated_at) VALUES ($1, $2, $3, $4)")
+	type request struct {
+		ArticleID string `param:"article_id"`
+	}
+	req := &request{}
+	if err := c.Bind(req); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := h.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		article, err := h.articleRepo.Find(ctx, tx, req.ArticleID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "Not Found")
+			}
+			return errors.WithStack(err)
+		}
+
+		deleted, err := h.favoriteRepo.Delete(ctx, tx, userID, article.ID)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		defer stmt.Close()
-		if _, err := stmt.ExecContext(ctx, userID, req.ArticleID, h.timer.Now(), h.timer.Now()); err != nil {
+		if !deleted {
+			return errors.WithStack(errFavoriteNotFound)
+		}
+		if err := h.articleRepo.AddTotalFavoriteCount(ctx, tx, article.ID, -1, h.timer.Now()); err != nil {
 			return errors.WithStack(err)
 		}
-		return nil
-	}); err != nil {
+		return errors.WithStack(h.writeEvent(ctx, tx, eventArticleUnfavorited, article.ID, &UserArticle{
+			UserID:    userID,
+			ArticleID: article.ID,
+		}))
+	}, withTxName("delete_favorite")); err != nil {
+		if errors.Is(err, errFavoriteNotFound) {
+			if h.favoriteDuplicates == favoriteDuplicateIgnore {
+				return c.NoContent(http.StatusOK)
+			}
+			return echo.NewHTTPError(http.StatusNotFound, "お気に入り登録していません。")
+		}
 		return errors.WithStack(err)
 	}
 
@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -20,21 +22,21 @@ import (
 
 // テストケースは直列前提
 var h = &handler{
-	db:       nil,
-	randUtil: nil,
+	db:    nil,
+	idGen: nil,
 }
 
-type randImplMock struct {
+type idGeneratorMock struct {
 	mock.Mock
 }
 
-func (r *randImplMock) NewString() string {
-	args := r.Called()
+func (g *idGeneratorMock) NewID() string {
+	args := g.Called()
 	return args.String(0)
 }
 
-func (r *randImplMock) Hit(rate, denominator int) bool {
-	return true
+func (g *idGeneratorMock) Strategy() string {
+	return "mock"
 }
 
 type timerImplMock struct {
@@ -55,9 +57,20 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+// TEST_DB=postgres の場合はローカルのPostgresを使い、それ以外はインメモリのリポジトリを使う
 func testMain() error {
 	ctx := context.Background()
 
+	if os.Getenv("TEST_DB") != "postgres" {
+		store := newMemoryStore()
+		h.db = store
+		h.userRepo = &memoryUserRepository{store: store}
+		h.articleRepo = &memoryArticleRepository{store: store}
+		h.favoriteRepo = &memoryFavoriteRepository{store: store}
+		h.idempotencyRepo = &memoryIdempotencyRepository{store: store}
+		return nil
+	}
+
 	conn, err := newConnection("127.0.0.1", "", "postgres", "postgres", "", "disable")
 	if err != nil {
 		return errors.WithStack(err)
@@ -76,26 +89,60 @@ func testMain() error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	sqlFile, err := os.ReadFile("./ddl.sql")
+	m, err := newMigrator(conn, dialectPostgres)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	if _, err := conn.ExecContext(ctx, string(sqlFile)); err != nil {
+	if err := m.Up(ctx); err != nil {
 		return errors.WithStack(err)
 	}
-	h.db = &dbExt{conn}
+	db := &dbExt{db: conn, txOptions: []txOption{withoutRetry()}}
+	h.db = db
+	h.userRepo = &sqlUserRepository{db: db}
+	h.articleRepo = &sqlArticleRepository{db: db}
+	h.favoriteRepo = &sqlFavoriteRepository{db: db}
+	h.idempotencyRepo = &sqlIdempotencyRepository{db: db}
 
 	return nil
 }
 
+// newMemoryHandler は他のテストケースとデータを共有しないハンドラーを作成する
+func newMemoryHandler() *handler {
+	store := newMemoryStore()
+	return &handler{
+		db:                           store,
+		userRepo:                     &memoryUserRepository{store: store},
+		articleRepo:                  &memoryArticleRepository{store: store},
+		favoriteRepo:                 &memoryFavoriteRepository{store: store},
+		idempotencyRepo:              &memoryIdempotencyRepository{store: store},
+		idempotencyTTL:               defaultIdempotencyTTL,
+		idempotencyProcessingTimeout: defaultIdempotencyProcessingTimeout,
+		articleBatchMax:              defaultArticleBatchMax,
+		favoriteDuplicates:           favoriteDuplicateConflict,
+		idGen:                        &uuidV4Generator{},
+		timer:                        &timerImpl{},
+	}
+}
+
 var baseTime = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
 
 var userName = strconv.FormatInt(baseTime.UnixNano(), 10)
 
 func doTestRequest(ctx context.Context, e *echo.Echo, method, path, body string) *httptest.ResponseRecorder {
+	return doTestRequestAs(ctx, e, userName, userName, method, path, body)
+}
+
+func doTestRequestAs(ctx context.Context, e *echo.Echo, userName, password, method, path, body string) *httptest.ResponseRecorder {
+	return doTestRequestWithHeader(ctx, e, userName, password, method, path, body, nil)
+}
+
+func doTestRequestWithHeader(ctx context.Context, e *echo.Echo, userName, password, method, path, body string, header http.Header) *httptest.ResponseRecorder {
 	req := httptest.NewRequestWithContext(ctx, method, path, strings.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
-	req.SetBasicAuth(userName+"@email.com", userName)
+	req.SetBasicAuth(userName+"@email.com", password)
 	rec := httptest.NewRecorder()
 	e.ServeHTTP(rec, req)
 	return rec
@@ -107,17 +154,17 @@ func Test_E2E(t *testing.T) {
 
 	var rec *httptest.ResponseRecorder
 
-	randImplMockInstance := &randImplMock{}
-	h.randUtil = randImplMockInstance
+	idGeneratorMockInstance := &idGeneratorMock{}
+	h.idGen = idGeneratorMockInstance
 	timerImplMockInstance := &timerImplMock{}
 	h.timer = timerImplMockInstance
 	defer func() {
-		randImplMockInstance.AssertExpectations(t)
+		idGeneratorMockInstance.AssertExpectations(t)
 		timerImplMockInstance.AssertExpectations(t)
 	}()
 
 	/* ユーザー登録 */
-	randImplMockInstance.On("NewString").Return("2f2812ce-4511-4095-a144-2cefcb120e62").Times(1)
+	idGeneratorMockInstance.On("NewID").Return("2f2812ce-4511-4095-a144-2cefcb120e62").Times(1)
 	timerImplMockInstance.On("Now").Return(baseTime.Add(1 * time.Millisecond).UTC()).Times(2)
 	rec = doTestRequest(ctx, e, http.MethodPost, "/user", fmt.Sprintf(`{
 		"name": "%s",
@@ -127,7 +174,7 @@ func Test_E2E(t *testing.T) {
 	require.Equal(t, http.StatusOK, rec.Code)
 
 	/* 記事作成1 */
-	randImplMockInstance.On("NewString").Return("cd4b2c08-3387-5238-bcf8-0b9f0b87e8ac").Times(1)
+	idGeneratorMockInstance.On("NewID").Return("cd4b2c08-3387-5238-bcf8-0b9f0b87e8ac").Times(1)
 	createdAt1 := baseTime.Add(21 * time.Millisecond).In(time.UTC)
 	updateAt1 := baseTime.Add(22 * time.Millisecond).In(time.UTC)
 	timerImplMockInstance.On("Now").Return(createdAt1).Times(1)
@@ -142,7 +189,7 @@ func Test_E2E(t *testing.T) {
 	require.Equal(t, http.StatusOK, rec.Code)
 
 	/* 記事作成2 */
-	randImplMockInstance.On("NewString").Return("5847a07c-84bd-7eda-9fad-b44c70bc9ffa").Times(1)
+	idGeneratorMockInstance.On("NewID").Return("5847a07c-84bd-7eda-9fad-b44c70bc9ffa").Times(1)
 	createdAt2 := baseTime.Add(31 * time.Millisecond).In(time.UTC)
 	updateAt2 := baseTime.Add(32 * time.Millisecond).In(time.UTC)
 	timerImplMockInstance.On("Now").Return(createdAt2).Times(1)
@@ -181,10 +228,12 @@ func Test_E2E(t *testing.T) {
 	"body": "body2",
 	"user_id": "2f2812ce-4511-4095-a144-2cefcb120e62",
 	"total_favorite_count": 0,
+	"version": 1,
 	"created_at": "%s",
 	"updated_at": "%s"
 }
 `, createdAt2.Format(time.RFC3339Nano), updateAt2.Format(time.RFC3339Nano)))
+	require.Equal(t, `"1"`, rec.Header().Get(headerETag))
 
 	/* 記事更新 */
 	updateAt3 := baseTime.Add(42 * time.Millisecond).In(time.UTC)
@@ -194,6 +243,7 @@ func Test_E2E(t *testing.T) {
 	"body": "body2-1"
 }`)
 	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, `"2"`, rec.Header().Get(headerETag))
 	rec = doTestRequest(ctx, e, http.MethodGet, "/article/5847a07c-84bd-7eda-9fad-b44c70bc9ffa", ``)
 	require.JSONEq(t, rec.Body.String(), fmt.Sprintf(`{
 	"id": "5847a07c-84bd-7eda-9fad-b44c70bc9ffa",
@@ -201,6 +251,7 @@ func Test_E2E(t *testing.T) {
 	"body": "body2-1",
 	"user_id": "2f2812ce-4511-4095-a144-2cefcb120e62",
 	"total_favorite_count": 0,
+	"version": 2,
 	"created_at": "%s",
 	"updated_at": "%s"
 }`, createdAt2.Format(time.RFC3339Nano), updateAt3.Format(time.RFC3339Nano)))
@@ -233,6 +284,7 @@ func Test_E2E(t *testing.T) {
 	"body": "body1",
 	"user_id": "2f2812ce-4511-4095-a144-2cefcb120e62",
 	"total_favorite_count": 1,
+	"version": 1,
 	"created_at": "%s",
 	"updated_at": "%s"
 }`, createdAt1.Format(time.RFC3339Nano), updatedAt4.Format(time.RFC3339Nano)))
@@ -247,4 +299,658 @@ func Test_E2E(t *testing.T) {
 		}
 	]
 }`)
+
+	/* お気に入りの重複登録(登録に失敗するのでお気に入り数は加算しない) */
+	timerImplMockInstance.On("Now").Return(baseTime.Add(61 * time.Millisecond).In(time.UTC)).Times(2)
+	rec = doTestRequest(ctx, e, http.MethodPost, "/favorite/article/cd4b2c08-3387-5238-bcf8-0b9f0b87e8ac", ``)
+	require.Equal(t, http.StatusConflict, rec.Code)
+
+	/* お気に入り解除 */
+	updatedAt5 := baseTime.Add(71 * time.Millisecond).In(time.UTC)
+	timerImplMockInstance.On("Now").Return(updatedAt5).Times(1)
+	rec = doTestRequest(ctx, e, http.MethodDelete, "/favorite/article/cd4b2c08-3387-5238-bcf8-0b9f0b87e8ac", ``)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = doTestRequest(ctx, e, http.MethodGet, "/article/cd4b2c08-3387-5238-bcf8-0b9f0b87e8ac", ``)
+	require.JSONEq(t, rec.Body.String(), fmt.Sprintf(`{
+	"id": "cd4b2c08-3387-5238-bcf8-0b9f0b87e8ac",
+	"title": "title1",
+	"body": "body1",
+	"user_id": "2f2812ce-4511-4095-a144-2cefcb120e62",
+	"total_favorite_count": 0,
+	"version": 1,
+	"created_at": "%s",
+	"updated_at": "%s"
+}`, createdAt1.Format(time.RFC3339Nano), updatedAt5.Format(time.RFC3339Nano)))
+	rec = doTestRequest(ctx, e, http.MethodGet, "/favorite/articles", ``)
+	require.JSONEq(t, rec.Body.String(), `{"list": []}`)
+
+	/* 解除済みのお気に入りの解除 */
+	rec = doTestRequest(ctx, e, http.MethodDelete, "/favorite/article/cd4b2c08-3387-5238-bcf8-0b9f0b87e8ac", ``)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func Test_ErrorPaths(t *testing.T) {
+	ctx := context.Background()
+	h := newMemoryHandler()
+	e := setupEcho(h)
+
+	var rec *httptest.ResponseRecorder
+	for _, name := range []string{"owner", "other"} {
+		rec = doTestRequestAs(ctx, e, name, name, http.MethodPost, "/user", fmt.Sprintf(`{
+	"name": "%s",
+	"email": "%s@email.com",
+	"password": "%s"
+}`, name, name, name))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodPost, "/article", `{
+	"title": "title1",
+	"body": "body1"
+}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	res := &struct {
+		ArticleID string `json:"article_id"`
+	}{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), res))
+	articlePath := "/article/" + res.ArticleID
+
+	/* 認証失敗 */
+	rec = doTestRequestAs(ctx, e, "owner", "wrong", http.MethodGet, "/articles", ``)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = doTestRequestAs(ctx, e, "unknown", "unknown", http.MethodGet, "/articles", ``)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	/* 存在しない記事 */
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodGet, "/article/unknown", ``)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodPatch, "/article/unknown", `{"title": "title2"}`)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodDelete, "/article/unknown", ``)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodPost, "/favorite/article/unknown", ``)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodDelete, "/favorite/article/unknown", ``)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	/* 他のユーザーの記事 */
+	rec = doTestRequestAs(ctx, e, "other", "other", http.MethodPatch, articlePath, `{"title": "title2"}`)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doTestRequestAs(ctx, e, "other", "other", http.MethodDelete, articlePath, ``)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	/* お気に入りの重複登録は409を返してロールバックされる */
+	rec = doTestRequestAs(ctx, e, "other", "other", http.MethodPost, "/favorite"+articlePath, ``)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = doTestRequestAs(ctx, e, "other", "other", http.MethodPost, "/favorite"+articlePath, ``)
+	require.Equal(t, http.StatusConflict, rec.Code)
+	favoriteCount := func() int {
+		rec := doTestRequestAs(ctx, e, "owner", "owner", http.MethodGet, articlePath, ``)
+		require.Equal(t, http.StatusOK, rec.Code)
+		article := &Article{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), article))
+		require.Equal(t, "title1", article.Title)
+		return article.TotalFavoriteCount
+	}
+	require.Equal(t, 1, favoriteCount())
+
+	/* お気に入り登録していない記事の解除は404 */
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodDelete, "/favorite"+articlePath, ``)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Equal(t, 1, favoriteCount())
+
+	/* 重複を無視する設定では何も変更せずに200を返す */
+	h.favoriteDuplicates = favoriteDuplicateIgnore
+	rec = doTestRequestAs(ctx, e, "other", "other", http.MethodPost, "/favorite"+articlePath, ``)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, 1, favoriteCount())
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodDelete, "/favorite"+articlePath, ``)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, 1, favoriteCount())
+}
+
+func Test_OptimisticConcurrency(t *testing.T) {
+	ctx := context.Background()
+	e := setupEcho(newMemoryHandler())
+
+	rec := doTestRequestAs(ctx, e, "owner", "owner", http.MethodPost, "/user", `{
+	"name": "owner",
+	"email": "owner@email.com",
+	"password": "owner"
+}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodPost, "/article", `{
+	"title": "title1",
+	"body": "body1"
+}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	res := &struct {
+		ArticleID string `json:"article_id"`
+	}{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), res))
+	articlePath := "/article/" + res.ArticleID
+
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodGet, articlePath, ``)
+	require.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get(headerETag)
+	require.Equal(t, `"1"`, etag)
+
+	ifMatch := func(v string) http.Header {
+		return http.Header{headerIfMatch: []string{v}}
+	}
+
+	/* ETagが一致すれば更新できる */
+	rec = doTestRequestWithHeader(ctx, e, "owner", "owner", http.MethodPatch, articlePath, `{"title": "title2"}`, ifMatch(etag))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, `"2"`, rec.Header().Get(headerETag))
+
+	/* 古いETagでの更新と削除は412 */
+	rec = doTestRequestWithHeader(ctx, e, "owner", "owner", http.MethodPatch, articlePath, `{"title": "title3"}`, ifMatch(etag))
+	require.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	rec = doTestRequestWithHeader(ctx, e, "owner", "owner", http.MethodDelete, articlePath, ``, ifMatch(etag))
+	require.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	// 弱いETagは一致しない
+	rec = doTestRequestWithHeader(ctx, e, "owner", "owner", http.MethodPatch, articlePath, `{"title": "title3"}`, ifMatch(`W/"2"`))
+	require.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodGet, articlePath, ``)
+	article := &Article{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), article))
+	require.Equal(t, "title2", article.Title)
+	require.Equal(t, int64(2), article.Version)
+
+	/* いずれかに一致するか*であれば削除できる */
+	rec = doTestRequestWithHeader(ctx, e, "owner", "owner", http.MethodDelete, articlePath, ``, ifMatch(`"1", "2"`))
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = doTestRequestWithHeader(ctx, e, "owner", "owner", http.MethodDelete, articlePath, ``, ifMatch("*"))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func Test_articleScenario_runConflictingEdits(t *testing.T) {
+	ctx := context.Background()
+	e := setupEcho(newMemoryHandler())
+
+	userName, err := (&userSpawnScenario{}).Run(ctx, e)
+	require.NoError(t, err)
+	rec, err := doLoadTestRequest(ctx, e, userName, http.MethodPost, "/article", `{"title": "title1", "body": "body1"}`)
+	require.NoError(t, err)
+	res := &struct {
+		ArticleID string `json:"article_id"`
+	}{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), res))
+
+	s := &articleScenario{conflictingEdits: true}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.runConflictingEdits(ctx, e, userName, res.ArticleID, i))
+	}
+}
+
+func Test_favoriteCounterShards(t *testing.T) {
+	ctx := context.Background()
+	h := newMemoryHandler()
+	store := h.db.(*memoryStore)
+	articleRepo := &memoryArticleRepository{store: store, counterShards: 4}
+	h.articleRepo = articleRepo
+	e := setupEcho(h)
+
+	owner, err := (&userSpawnScenario{}).Run(ctx, e)
+	require.NoError(t, err)
+	rec, err := doLoadTestRequest(ctx, e, owner, http.MethodPost, "/article", `{"title": "title1", "body": "body1"}`)
+	require.NoError(t, err)
+	res := &struct {
+		ArticleID string `json:"article_id"`
+	}{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), res))
+
+	/* 同じ記事へのお気に入り登録はカウンターに分散して加算され、記事の行は更新されない */
+	for i := 0; i < 20; i++ {
+		userName, err := (&userSpawnScenario{}).Run(ctx, e)
+		require.NoError(t, err)
+		rec, err := doLoadTestRequest(ctx, e, userName, http.MethodPost, "/favorite/article/"+res.ArticleID, ``)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	require.LessOrEqual(t, len(store.counters), 4)
+	require.Equal(t, 0, store.articles[res.ArticleID].TotalFavoriteCount)
+
+	rec, err = doLoadTestRequest(ctx, e, owner, http.MethodGet, "/article/"+res.ArticleID, ``)
+	require.NoError(t, err)
+	article := &Article{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), article))
+	require.Equal(t, 20, article.TotalFavoriteCount)
+	require.Equal(t, int64(1), article.Version)
+
+	/* 数え直すとカウンターは記事に集約される(記事の行にずれがある状態にしておく) */
+	timerMock := &timerImplMock{}
+	timerMock.On("Now").Return(baseTime)
+	a := store.articles[res.ArticleID]
+	a.TotalFavoriteCount = 1
+	store.articles[res.ArticleID] = a
+	result, err := (&favoriteCountReconciler{
+		db:           store,
+		articleRepo:  articleRepo,
+		favoriteRepo: h.favoriteRepo,
+		timer:        timerMock,
+		batchSize:    10,
+	}).Run(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Corrected)
+	require.Empty(t, store.counters)
+	require.Equal(t, 20, store.articles[res.ArticleID].TotalFavoriteCount)
+}
+
+func Test_deleteArticleCascade(t *testing.T) {
+	ctx := context.Background()
+	h := newMemoryHandler()
+	store := h.db.(*memoryStore)
+	h.articleRepo = &memoryArticleRepository{store: store, counterShards: 2}
+	e := setupEcho(h)
+
+	owner, err := (&userSpawnScenario{}).Run(ctx, e)
+	require.NoError(t, err)
+	rec, err := doLoadTestRequest(ctx, e, owner, http.MethodPost, "/article", `{"title": "title1", "body": "body1"}`)
+	require.NoError(t, err)
+	res := &struct {
+		ArticleID string `json:"article_id"`
+	}{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), res))
+	rec, err = doLoadTestRequest(ctx, e, owner, http.MethodPost, "/favorite/article/"+res.ArticleID, ``)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotEmpty(t, store.usersArticles)
+	require.NotEmpty(t, store.counters)
+
+	/* 外部キーが無くても記事と同じトランザクションでお気に入りとカウンターを削除する */
+	rec, err = doLoadTestRequest(ctx, e, owner, http.MethodDelete, "/article/"+res.ArticleID, ``)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, store.articles)
+	require.Empty(t, store.usersArticles)
+	require.Empty(t, store.counters)
+
+	/* 1トランザクションの行数に上限がある場合は、記事を削除してからお気に入りを別のトランザクションで少しずつ削除する */
+	h.maxRowsPerTx = 2
+	rec, err = doLoadTestRequest(ctx, e, owner, http.MethodPost, "/article", `{"title": "title2", "body": "body2"}`)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), res))
+	for i := 0; i < 3; i++ {
+		fan, err := (&userSpawnScenario{}).Run(ctx, e)
+		require.NoError(t, err)
+		rec, err = doLoadTestRequest(ctx, e, fan, http.MethodPost, "/favorite/article/"+res.ArticleID, ``)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	require.Len(t, store.usersArticles, 3)
+
+	// 著者以外はお気に入りも削除できない
+	other, err := (&userSpawnScenario{}).Run(ctx, e)
+	require.NoError(t, err)
+	rec, err = doLoadTestRequest(ctx, e, other, http.MethodDelete, "/article/"+res.ArticleID, ``)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Len(t, store.usersArticles, 3)
+
+	// バージョンが一致しない場合もお気に入りを削除しない
+	rec = doTestRequestWithHeader(ctx, e, owner, owner, http.MethodDelete, "/article/"+res.ArticleID, ``, http.Header{headerIfMatch: []string{`"999"`}})
+	require.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	require.Len(t, store.articles, 1)
+	require.Len(t, store.usersArticles, 3)
+
+	rec, err = doLoadTestRequest(ctx, e, owner, http.MethodDelete, "/article/"+res.ArticleID, ``)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, store.articles)
+	require.Empty(t, store.usersArticles)
+	require.Empty(t, store.counters)
+}
+
+func Test_Idempotency(t *testing.T) {
+	ctx := context.Background()
+	h := newMemoryHandler()
+	store := h.db.(*memoryStore)
+	e := setupEcho(h)
+
+	owner, err := (&userSpawnScenario{}).Run(ctx, e)
+	require.NoError(t, err)
+	other, err := (&userSpawnScenario{}).Run(ctx, e)
+	require.NoError(t, err)
+	idempotencyKey := func(key string) http.Header {
+		return http.Header{headerIdempotencyKey: []string{key}}
+	}
+
+	/* 同じキーの再送は最初のレスポンスを返し、記事は1件だけ作成される */
+	rec1 := doTestRequestWithHeader(ctx, e, owner, owner, http.MethodPost, "/article", `{"title": "title1", "body": "body1"}`, idempotencyKey("key1"))
+	require.Equal(t, http.StatusOK, rec1.Code)
+	rec2 := doTestRequestWithHeader(ctx, e, owner, owner, http.MethodPost, "/article", `{"title": "title1", "body": "body1"}`, idempotencyKey("key1"))
+	require.Equal(t, http.StatusOK, rec2.Code)
+	require.Equal(t, rec1.Body.String(), rec2.Body.String())
+	require.Equal(t, "true", rec2.Header().Get(headerIdempotentReplayed))
+	require.Len(t, store.articles, 1)
+	res := &struct {
+		ArticleID string `json:"article_id"`
+	}{}
+	require.NoError(t, json.Unmarshal(rec1.Body.Bytes(), res))
+
+	/* 同じキーで別のリクエストを送ると422 */
+	rec := doTestRequestWithHeader(ctx, e, owner, owner, http.MethodPost, "/article", `{"title": "title2", "body": "body2"}`, idempotencyKey("key1"))
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	/* キーはユーザー毎 */
+	rec = doTestRequestWithHeader(ctx, e, other, other, http.MethodPost, "/article", `{"title": "title1", "body": "body1"}`, idempotencyKey("key1"))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, rec.Header().Get(headerIdempotentReplayed))
+	require.Len(t, store.articles, 2)
+
+	/* お気に入り登録の再送は500にならない */
+	for i := 0; i < 2; i++ {
+		rec = doTestRequestWithHeader(ctx, e, other, other, http.MethodPost, "/favorite/article/"+res.ArticleID, ``, idempotencyKey("key2"))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	require.Equal(t, 1, store.articles[res.ArticleID].TotalFavoriteCount)
+
+	/* エラーのレスポンスも保存する(5xxは保存しない) */
+	for i := 0; i < 2; i++ {
+		rec = doTestRequestWithHeader(ctx, e, owner, owner, http.MethodPost, "/favorite/article/unknown", ``, idempotencyKey("key3"))
+		require.Equal(t, http.StatusNotFound, rec.Code)
+	}
+	require.Equal(t, "true", rec.Header().Get(headerIdempotentReplayed))
+
+	/* 処理中のキーは409 */
+	ownerID := store.articles[res.ArticleID].UserID
+	store.idempotency[[2]string{ownerID, "key4"}] = IdempotencyKey{Scope: ownerID, Key: "key4", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	rec = doTestRequestWithHeader(ctx, e, owner, owner, http.MethodPost, "/article", `{"title": "title1", "body": "body1"}`, idempotencyKey("key4"))
+	require.Equal(t, http.StatusConflict, rec.Code)
+
+	/* 処理中のタイムアウトを過ぎたキーは引き継いで再実行する(プロセスの停止やレスポンスの保存の失敗で残ったキー) */
+	k4 := store.idempotency[[2]string{ownerID, "key4"}]
+	k4.CreatedAt = time.Now().Add(-h.idempotencyProcessingTimeout - time.Second)
+	store.idempotency[[2]string{ownerID, "key4"}] = k4
+	rec = doTestRequestWithHeader(ctx, e, owner, owner, http.MethodPost, "/article", `{"title": "title1", "body": "body1"}`, idempotencyKey("key4"))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, http.StatusOK, store.idempotency[[2]string{ownerID, "key4"}].Status)
+
+	/* 有効期限切れのキーは再実行する */
+	k := store.idempotency[[2]string{ownerID, "key1"}]
+	k.ExpiresAt = time.Now().Add(-time.Second)
+	store.idempotency[[2]string{ownerID, "key1"}] = k
+	rec = doTestRequestWithHeader(ctx, e, owner, owner, http.MethodPost, "/article", `{"title": "title1", "body": "body1"}`, idempotencyKey("key1"))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotEqual(t, rec1.Body.String(), rec.Body.String())
+	require.Len(t, store.articles, 4)
+}
+
+func Test_loadTestClientRetry(t *testing.T) {
+	ctx := context.Background()
+	h := newMemoryHandler()
+	store := h.db.(*memoryStore)
+	e := setupEcho(h)
+
+	/* 全てのPOSTを同じIdempotency-Keyで再送しても重複しない */
+	ctx = withLoadTestClientRetry(ctx, &loadTestClientRetry{idempotencyKeys: true, retryRate: 100})
+	owner, err := (&userSpawnScenario{}).Run(ctx, e)
+	require.NoError(t, err)
+	rec, err := doLoadTestRequest(ctx, e, owner, http.MethodPost, "/article", `{"title": "title1", "body": "body1"}`)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "true", rec.Header().Get(headerIdempotentReplayed))
+	require.Len(t, store.users, 1)
+	require.Len(t, store.articles, 1)
+	require.Len(t, store.idempotency, 2)
+}
+
+func Test_queryBudget(t *testing.T) {
+	ctx := context.Background()
+	h := newMemoryHandler()
+	e := setupEcho(h)
+
+	/* エンドポイント毎の文の数(インメモリ実装ではリポジトリのメソッドの呼び出し回数。認証の1回を含む) */
+	request := func(method, path, body string, statements int) *httptest.ResponseRecorder {
+		t.Helper()
+		ctx, stats := withQueryStats(ctx)
+		rec := doTestRequestAs(ctx, e, "owner", "owner", method, path, body)
+		require.Equal(t, http.StatusOK, rec.Code, method+" "+path)
+		require.Equal(t, statements, stats.Queries(), method+" "+path)
+		return rec
+	}
+	request(http.MethodPost, "/user", `{"name": "owner", "email": "owner@email.com", "password": "owner"}`, 1)
+	rec := request(http.MethodPost, "/article", `{"title": "title1", "body": "body1"}`, 2)
+	res := &struct {
+		ArticleID string `json:"article_id"`
+	}{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), res))
+	articlePath := "/article/" + res.ArticleID
+	request(http.MethodPost, "/articles/batch", `{"articles": [{"title": "title2", "body": "body2"}, {"title": "title3", "body": "body3"}]}`, 2)
+	request(http.MethodGet, "/articles", ``, 2)
+	request(http.MethodGet, articlePath, ``, 2)
+	request(http.MethodPatch, articlePath, `{"title": "title2"}`, 3)
+	request(http.MethodPost, "/favorite"+articlePath, ``, 4)
+	request(http.MethodGet, "/favorite/articles", ``, 2)
+	request(http.MethodDelete, "/favorite"+articlePath, ``, 4)
+	request(http.MethodDelete, articlePath, ``, 4)
+
+	/* 上限を超えた場合、警告だけの設定ではそのまま返し、失敗させる設定では500にする */
+	h.queryBudget = &queryBudget{maxStatements: 1}
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodGet, "/articles", ``)
+	require.Equal(t, http.StatusOK, rec.Code)
+	h.queryBudget = &queryBudget{maxStatements: 1, fail: true}
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodGet, "/articles", ``)
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	require.Contains(t, rec.Body.String(), "statements")
+	h.queryBudget = &queryBudget{maxStatements: 2, fail: true}
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodGet, "/articles", ``)
+	require.Equal(t, http.StatusOK, rec.Code)
+	// 溜めたレスポンスはそのまま返す
+	require.Contains(t, rec.Body.String(), `"title":"title3"`)
+	require.NotEmpty(t, rec.Header().Get(echo.HeaderXRequestID))
+
+	/* 同じクエリを繰り返し実行した場合はN+1として検出する */
+	_, stats := withQueryStats(ctx)
+	for i := 0; i < 3; i++ {
+		stats.addQuery("SELECT * FROM articles WHERE id = $1", time.Millisecond)
+	}
+	stats.addQuery("SELECT * FROM users WHERE email = $1", time.Millisecond)
+	query, n := stats.MostRepeated()
+	require.Equal(t, "SELECT * FROM articles WHERE id = $1", query)
+	require.Equal(t, 3, n)
+	require.Equal(t, 4*time.Millisecond, stats.DBTime())
+	require.Equal(t, "repeats", (&queryBudget{maxRepeats: 2}).exceeded(stats))
+	require.Equal(t, "", (&queryBudget{maxStatements: 4, maxRepeats: 3}).exceeded(stats))
+}
+
+func Test_postArticleBatch(t *testing.T) {
+	ctx := context.Background()
+	h := newMemoryHandler()
+	store := h.db.(*memoryStore)
+	e := setupEcho(h)
+
+	rec := doTestRequestAs(ctx, e, "owner", "owner", http.MethodPost, "/user", `{"name": "owner", "email": "owner@email.com", "password": "owner"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	type result struct {
+		ArticleID string `json:"article_id"`
+		Error     string `json:"error"`
+	}
+	type response struct {
+		Results []*result `json:"results"`
+	}
+	res := &response{}
+
+	/* 1件でも不正な記事があれば何も作成しない */
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodPost, "/articles/batch", `{"articles": [
+	{"title": "title1", "body": "body1"},
+	{"title": "", "body": "body2"}
+]}`)
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	res = &response{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), res))
+	require.Len(t, res.Results, 2)
+	require.Empty(t, res.Results[0].Error)
+	require.NotEmpty(t, res.Results[1].Error)
+	require.Empty(t, store.articles)
+
+	/* 記事数が0件か上限を超える場合 */
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodPost, "/articles/batch", `{"articles": []}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	h.articleBatchMax = 1
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodPost, "/articles/batch", `{"articles": [{"title": "t", "body": "b"}, {"title": "t", "body": "b"}]}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	h.articleBatchMax = defaultArticleBatchMax
+
+	/* 1トランザクションの行数の上限を超えないように分けて作成する */
+	h.maxRowsPerTx = 2
+	ctx, stats := withQueryStats(ctx)
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodPost, "/articles/batch", `{"articles": [
+	{"title": "title1", "body": "body1"},
+	{"title": "title2", "body": "body2"},
+	{"title": "title3", "body": "body3"},
+	{"title": "title4", "body": "body4"},
+	{"title": "title5", "body": "body5"}
+]}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	// 認証の1回と、2件ずつ3回のINSERT
+	require.Equal(t, 4, stats.Queries())
+	res = &response{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), res))
+	require.Len(t, res.Results, 5)
+	for i, r := range res.Results {
+		require.Empty(t, r.Error)
+		article, ok := store.articles[r.ArticleID]
+		require.True(t, ok)
+		require.Equal(t, fmt.Sprintf("title%d", i+1), article.Title)
+	}
+	firstID := res.Results[0].ArticleID
+	ctx = context.Background()
+
+	/* 途中のトランザクションが失敗した場合は作成済みの記事のIDと残りのエラーを返す */
+	idGeneratorMockInstance := &idGeneratorMock{}
+	h.idGen = idGeneratorMockInstance
+	idGeneratorMockInstance.On("NewID").Return("batch-1").Times(1)
+	idGeneratorMockInstance.On("NewID").Return("batch-2").Times(1)
+	idGeneratorMockInstance.On("NewID").Return(firstID).Times(1)
+	idempotencyKey := http.Header{headerIdempotencyKey: []string{"batch-key"}}
+	rec = doTestRequestWithHeader(ctx, e, "owner", "owner", http.MethodPost, "/articles/batch", `{"articles": [
+	{"title": "title6", "body": "body6"},
+	{"title": "title7", "body": "body7"},
+	{"title": "title8", "body": "body8"}
+]}`, idempotencyKey)
+	idGeneratorMockInstance.AssertExpectations(t)
+	require.Equal(t, http.StatusMultiStatus, rec.Code)
+	res = &response{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), res))
+	require.Equal(t, []*result{{ArticleID: "batch-1"}, {ArticleID: "batch-2"}, {Error: "記事の作成に失敗しました。"}}, res.Results)
+	require.Len(t, store.articles, 7)
+	require.Equal(t, "title1", store.articles[firstID].Title)
+	h.idGen = &uuidV4Generator{}
+
+	/* 207はIdempotency-Keyに保存しないので、失敗した記事だけを同じキーで再送できる */
+	rec = doTestRequestWithHeader(ctx, e, "owner", "owner", http.MethodPost, "/articles/batch", `{"articles": [
+	{"title": "title8", "body": "body8"}
+]}`, idempotencyKey)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, rec.Header().Get(headerIdempotentReplayed))
+	require.Len(t, store.articles, 8)
+
+	/* 初期化シナリオは1人のユーザーでまとめて作成する */
+	articleIDs, err := (&initScenario{}).Run(ctx, e)
+	require.NoError(t, err)
+	require.Len(t, articleIDs, 10)
+	require.Len(t, store.articles, 18)
+}
+
+func Test_getArticleListPagination(t *testing.T) {
+	ctx := context.Background()
+	h := newMemoryHandler()
+	e := setupEcho(h)
+
+	for _, name := range []string{"owner", "other"} {
+		rec := doTestRequestAs(ctx, e, name, name, http.MethodPost, "/user", fmt.Sprintf(`{"name": "%s", "email": "%s@email.com", "password": "%s"}`, name, name, name))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	// 一括作成した記事は作成日時が同じなので id で並ぶ
+	rec := doTestRequestAs(ctx, e, "owner", "owner", http.MethodPost, "/articles/batch", `{"articles": [
+	{"title": "title1", "body": "body1"},
+	{"title": "title2", "body": "body2"},
+	{"title": "title3", "body": "body3"},
+	{"title": "title4", "body": "body4"},
+	{"title": "title5", "body": "body5"}
+]}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	res := &struct {
+		Results []*struct {
+			ArticleID string `json:"article_id"`
+		} `json:"results"`
+	}{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), res))
+	ids := make([]string, 0, len(res.Results))
+	for _, r := range res.Results {
+		ids = append(ids, r.ArticleID)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+
+	/* next_cursor を辿って重複なく全ての記事を取得する */
+	got, err := pageArticles(ctx, e, "owner", articleSortNewest, 2, 10)
+	require.NoError(t, err)
+	require.Equal(t, ids, got)
+	got, err = pageArticles(ctx, e, "owner", articleSortOldest, 2, 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{ids[4], ids[3], ids[2], ids[1], ids[0]}, got)
+
+	/* お気に入り数の多い順 */
+	rec = doTestRequestAs(ctx, e, "other", "other", http.MethodPost, "/favorite/article/"+ids[3], ``)
+	require.Equal(t, http.StatusOK, rec.Code)
+	got, err = pageArticles(ctx, e, "owner", articleSortFavorites, 2, 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{ids[3], ids[0], ids[1], ids[2], ids[4]}, got)
+
+	/* 最後のページでは next_cursor を返さない */
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodGet, "/articles?limit=1000", ``)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotContains(t, rec.Body.String(), "next_cursor")
+
+	/* 不正なパラメーター */
+	rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodGet, "/articles?limit=1", ``)
+	require.Equal(t, http.StatusOK, rec.Code)
+	page := &struct {
+		NextCursor string `json:"next_cursor"`
+	}{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), page))
+	require.NotEmpty(t, page.NextCursor)
+	for _, query := range []string{
+		"sort=popular",
+		"limit=-1",
+		"cursor=invalid",
+		"sort=oldest&cursor=" + page.NextCursor,
+	} {
+		rec = doTestRequestAs(ctx, e, "owner", "owner", http.MethodGet, "/articles?"+query, ``)
+		require.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+// favoritesOnly は記事の作成(90%の判定)を外し、それ以外の確率判定を当たりにする
+type favoritesOnly struct{}
+
+func (favoritesOnly) Hit(rate, _ int) bool {
+	return rate != 90
+}
+
+func Test_articleScenario_favorites(t *testing.T) {
+	ctx := context.Background()
+	h := newMemoryHandler()
+	store := h.db.(*memoryStore)
+	e := setupEcho(h)
+
+	initArticleIDs, err := (&initScenario{}).Run(ctx, e)
+	require.NoError(t, err)
+	userName, err := (&userSpawnScenario{}).Run(ctx, e)
+	require.NoError(t, err)
+
+	/* お気に入り登録、重複登録、解除を全て実行する */
+	require.NoError(t, (&articleScenario{randUtil: favoritesOnly{}}).Run(ctx, e, userName, initArticleIDs))
+	user, err := h.userRepo.FindByEmail(ctx, userName+"@email.com")
+	require.NoError(t, err)
+	for i, articleID := range initArticleIDs {
+		_, favorited := store.usersArticles[[2]string{user.ID, articleID}]
+		require.Equal(t, i != 0, favorited, articleID)
+		article, err := h.articleRepo.Find(ctx, nil, articleID)
+		require.NoError(t, err)
+		require.Equal(t, store.countFavorites(articleID), article.TotalFavoriteCount, articleID)
+	}
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/uuid"
+	"github.com/oklog/ulid/v2"
+)
+
+// idGenerator はユーザーや記事のIDを発行する
+// Limitlessではシャードの分散に、Postgresでは主キーのB-treeの局所性に影響する
+type idGenerator interface {
+	NewID() string
+	Strategy() string
+}
+
+const (
+	idStrategyUUIDv4    = "uuidv4"
+	idStrategyUUIDv7    = "uuidv7"
+	idStrategyULID      = "ulid"
+	idStrategySnowflake = "snowflake"
+)
+
+// newIDGenerator は strategy に応じたIDの発行方式を返す
+// snowflake の場合は node に 0〜1023 のノードIDを指定する
+func newIDGenerator(strategy string, node int64) (idGenerator, error) {
+	switch strategy {
+	case "", idStrategyUUIDv4:
+		return &uuidV4Generator{}, nil
+	case idStrategyUUIDv7:
+		return &uuidV7Generator{}, nil
+	case idStrategyULID:
+		return &ulidGenerator{}, nil
+	case idStrategySnowflake:
+		if node < 0 || node > snowflakeMaxNode {
+			return nil, errors.Newf("snowflakeのノードIDは0〜%dで指定してください。: %d", snowflakeMaxNode, node)
+		}
+		return &snowflakeGenerator{node: node, epoch: snowflakeEpoch, now: time.Now}, nil
+	}
+	return nil, errors.Newf("未対応のID生成方式です。: %s", strategy)
+}
+
+// newIDGeneratorFromEnv は APP_ID_STRATEGY と APP_SNOWFLAKE_NODE からIDの発行方式を返す
+func newIDGeneratorFromEnv() (idGenerator, error) {
+	return newIDGeneratorFromEnvPrefix("")
+}
+
+// newIDGeneratorFromEnvPrefix は <prefix>APP_ID_STRATEGY のように接頭辞付きの環境変数を優先して読み込む
+// snowflake の場合、ノードIDが重複すると同じIDを発行するため、APP_SNOWFLAKE_NODE の指定を必須にする
+func newIDGeneratorFromEnvPrefix(prefix string) (idGenerator, error) {
+	getenv := prefixedGetenv(prefix)
+	strategy := getenv("APP_ID_STRATEGY")
+	var node int64
+	if v := getenv("APP_SNOWFLAKE_NODE"); v != "" {
+		var err error
+		if node, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	} else if strategy == idStrategySnowflake {
+		return nil, errors.New("APP_ID_STRATEGY=snowflake の場合は APP_SNOWFLAKE_NODE にプロセス毎に異なるノードIDを指定してください。")
+	}
+	g, err := newIDGenerator(strategy, node)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return g, nil
+}
+
+// uuidV4Generator はランダムなUUID
+type uuidV4Generator struct{}
+
+func (g *uuidV4Generator) NewID() string {
+	return uuid.NewString()
+}
+
+func (g *uuidV4Generator) Strategy() string {
+	return idStrategyUUIDv4
+}
+
+// uuidV7Generator は先頭48bitがミリ秒のタイムスタンプのUUID
+type uuidV7Generator struct{}
+
+func (g *uuidV7Generator) NewID() string {
+	return uuid.Must(uuid.NewV7()).String()
+}
+
+func (g *uuidV7Generator) Strategy() string {
+	return idStrategyUUIDv7
+}
+
+// ulidGenerator は同一ミリ秒内でも単調増加するULID
+type ulidGenerator struct{}
+
+func (g *ulidGenerator) NewID() string {
+	return ulid.Make().String()
+}
+
+func (g *ulidGenerator) Strategy() string {
+	return idStrategyULID
+}
+
+const (
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+	snowflakeMaxNode      = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSequence  = 1<<snowflakeSequenceBits - 1
+)
+
+var snowflakeEpoch = time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)
+
+// snowflakeGenerator はタイムスタンプ(41bit)、ノードID(10bit)、シーケンス(12bit)を並べた64bit整数を10進数の文字列にしたもの
+// 同一ミリ秒内でシーケンスを使い切った場合や時計が戻った場合は、最後に発行したタイムスタンプを進めて単調増加を保つ
+type snowflakeGenerator struct {
+	node  int64
+	epoch time.Time
+	now   func() time.Time
+
+	mu       sync.Mutex
+	lastTime int64
+	sequence int64
+}
+
+func (g *snowflakeGenerator) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := g.now().Sub(g.epoch).Milliseconds()
+	if ms <= g.lastTime {
+		g.sequence = (g.sequence + 1) & snowflakeMaxSequence
+		ms = g.lastTime
+		if g.sequence == 0 {
+			ms++
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.lastTime = ms
+	id := ms<<(snowflakeNodeBits+snowflakeSequenceBits) | g.node<<snowflakeSequenceBits | g.sequence
+	return strconv.FormatInt(id, 10)
+}
+
+func (g *snowflakeGenerator) Strategy() string {
+	return idStrategySnowflake
+}
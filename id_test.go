@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_newIDGenerator(t *testing.T) {
+	tests := []struct {
+		strategy string
+		validate func(t *testing.T, id string)
+	}{
+		{
+			strategy: idStrategyUUIDv4,
+			validate: func(t *testing.T, id string) {
+				require.Equal(t, uuid.Version(4), uuid.MustParse(id).Version())
+			},
+		},
+		{
+			strategy: idStrategyUUIDv7,
+			validate: func(t *testing.T, id string) {
+				require.Equal(t, uuid.Version(7), uuid.MustParse(id).Version())
+			},
+		},
+		{
+			strategy: idStrategyULID,
+			validate: func(t *testing.T, id string) {
+				_, err := ulid.ParseStrict(id)
+				require.NoError(t, err)
+			},
+		},
+		{
+			strategy: idStrategySnowflake,
+			validate: func(t *testing.T, id string) {
+				_, err := strconv.ParseInt(id, 10, 64)
+				require.NoError(t, err)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			g, err := newIDGenerator(tt.strategy, 1)
+			require.NoError(t, err)
+			require.Equal(t, tt.strategy, g.Strategy())
+			ids := make([]string, 0, 100)
+			seen := make(map[string]bool)
+			for i := 0; i < 100; i++ {
+				id := g.NewID()
+				tt.validate(t, id)
+				require.False(t, seen[id])
+				seen[id] = true
+				ids = append(ids, id)
+			}
+			if tt.strategy != idStrategyUUIDv4 && tt.strategy != idStrategySnowflake {
+				// 時刻順のIDは文字列としても発行順に並ぶ
+				require.True(t, sort.StringsAreSorted(ids))
+			}
+		})
+	}
+
+	_, err := newIDGenerator("uuidv1", 0)
+	require.Error(t, err)
+	_, err = newIDGenerator(idStrategySnowflake, snowflakeMaxNode+1)
+	require.Error(t, err)
+}
+
+func Test_newIDGeneratorFromEnv(t *testing.T) {
+	/* snowflakeはノードIDを指定しないと起動できない */
+	t.Setenv("APP_ID_STRATEGY", idStrategySnowflake)
+	t.Setenv("APP_SNOWFLAKE_NODE", "")
+	_, err := newIDGeneratorFromEnv()
+	require.Error(t, err)
+
+	t.Setenv("APP_SNOWFLAKE_NODE", "0")
+	g, err := newIDGeneratorFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, idStrategySnowflake, g.Strategy())
+
+	/* 接頭辞付きの設定でもノードIDは必須 */
+	t.Setenv("APP_SNOWFLAKE_NODE", "")
+	t.Setenv("PROFILE_SNOWFLAKE_APP_ID_STRATEGY", idStrategySnowflake)
+	t.Setenv("APP_ID_STRATEGY", "")
+	_, err = newIDGeneratorFromEnvPrefix("PROFILE_SNOWFLAKE_")
+	require.Error(t, err)
+
+	/* 他の方式ではノードIDは不要 */
+	g, err = newIDGeneratorFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, idStrategyUUIDv4, g.Strategy())
+}
+
+func Test_snowflakeGenerator(t *testing.T) {
+	now := snowflakeEpoch.Add(time.Second)
+	g := &snowflakeGenerator{node: 3, epoch: snowflakeEpoch, now: func() time.Time { return now }}
+
+	parse := func(id string) (ms, node, seq int64) {
+		n, err := strconv.ParseInt(id, 10, 64)
+		require.NoError(t, err)
+		return n >> (snowflakeNodeBits + snowflakeSequenceBits), n >> snowflakeSequenceBits & snowflakeMaxNode, n & snowflakeMaxSequence
+	}
+
+	ms, node, seq := parse(g.NewID())
+	require.Equal(t, int64(1000), ms)
+	require.Equal(t, int64(3), node)
+	require.Equal(t, int64(0), seq)
+
+	// 同一ミリ秒内はシーケンスを進め、使い切ったらタイムスタンプを進める
+	var last int64
+	for i := 0; i < snowflakeMaxSequence+1; i++ {
+		id, err := strconv.ParseInt(g.NewID(), 10, 64)
+		require.NoError(t, err)
+		require.Greater(t, id, last)
+		last = id
+	}
+	ms, _, seq = parse(strconv.FormatInt(last, 10))
+	require.Equal(t, int64(1001), ms)
+	require.Equal(t, int64(0), seq)
+
+	// 時計が戻っても単調増加を保つ
+	now = now.Add(-time.Minute)
+	id, err := strconv.ParseInt(g.NewID(), 10, 64)
+	require.NoError(t, err)
+	require.Greater(t, id, last)
+}
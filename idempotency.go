@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	headerIdempotencyKey     = "Idempotency-Key"
+	headerIdempotentReplayed = "Idempotent-Replayed"
+)
+
+const (
+	defaultIdempotencyTTL               = 24 * time.Hour
+	defaultIdempotencyProcessingTimeout = time.Minute
+	maxIdempotencyKeyLen                = 255
+)
+
+// idempotencyTTLFromEnv は APP_IDEMPOTENCY_TTL からIdempotency-Keyの有効期限を返す
+func idempotencyTTLFromEnv() (time.Duration, error) {
+	ttl, err := durationFromEnv("APP_IDEMPOTENCY_TTL", defaultIdempotencyTTL)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return ttl, nil
+}
+
+// idempotencyProcessingTimeoutFromEnv は APP_IDEMPOTENCY_PROCESSING_TIMEOUT から処理中のキーを引き継げるようになるまでの時間を返す
+func idempotencyProcessingTimeoutFromEnv() (time.Duration, error) {
+	timeout, err := durationFromEnv("APP_IDEMPOTENCY_PROCESSING_TIMEOUT", defaultIdempotencyProcessingTimeout)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return timeout, nil
+}
+
+// requestHash は同じキーで別のリクエストが送られていないか確認するためのハッシュ
+func requestHash(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// bodyRecorder はクライアントに書き込んだレスポンスボディを記録する
+type bodyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotency は Idempotency-Key を指定したリクエストの最初のレスポンスを保存し、同じキーのリクエストには保存したレスポンスを返す
+// キーはユーザー毎(ユーザー登録は認証が無いので全体で1つ)に有効期限まで保持する
+// 処理中のキーには 409 Conflict、別のリクエストで使われたキーには 422 Unprocessable Entity を返す
+// 5xxと207(一部だけ成功した)のレスポンスは保存せず、同じキーで再実行できるようにする
+// プロセスの停止やレスポンスの保存の失敗で処理中のまま残ったキーは、h.idempotencyProcessingTimeout を過ぎると次のリクエストが引き継いで再実行する
+func (h *handler) idempotency(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(headerIdempotencyKey)
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			return echo.NewHTTPError(http.StatusBadRequest, "Idempotency-Keyが長すぎます。")
+		}
+		ctx := c.Request().Context()
+		scope := ""
+		if cc := Extract(ctx); cc != nil {
+			scope = cc.User.ID
+		}
+
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+		now := h.timer.Now()
+		record := &IdempotencyKey{
+			Scope:       scope,
+			Key:         key,
+			RequestHash: requestHash(c.Request().Method, c.Request().URL.Path, body),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(h.idempotencyTTL),
+		}
+		var existing *IdempotencyKey
+		if err := h.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+			existing = nil
+			reserved, err := h.idempotencyRepo.Reserve(ctx, tx, record, now.Add(-h.idempotencyProcessingTimeout))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if reserved {
+				return nil
+			}
+			existing, err = h.idempotencyRepo.Find(ctx, tx, scope, key, now)
+			if errors.Is(err, sql.ErrNoRows) {
+				// 登録済みの記録がちょうど有効期限切れになった
+				return echo.NewHTTPError(http.StatusConflict, "同じIdempotency-Keyのリクエストを処理中です。")
+			}
+			return errors.WithStack(err)
+		}, withTxName("reserve_idempotency_key")); err != nil {
+			return errors.WithStack(err)
+		}
+		if existing != nil {
+			switch {
+			case existing.Status == 0:
+				return echo.NewHTTPError(http.StatusConflict, "同じIdempotency-Keyのリクエストを処理中です。")
+			case existing.RequestHash != record.RequestHash:
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, "Idempotency-Keyが別のリクエストで使われています。")
+			}
+			c.Response().Header().Set(headerIdempotentReplayed, "true")
+			if existing.Body == "" {
+				return c.NoContent(existing.Status)
+			}
+			return c.Blob(existing.Status, existing.ContentType, []byte(existing.Body))
+		}
+
+		// エラーのレスポンスも保存するため、ここでエラーハンドラーを呼び出してレスポンスを書き込む
+		// エラーはトレースやログのために上位のミドルウェアにも返す(書き込み済みのレスポンスはエラーハンドラーが再度書き込まない)
+		recorder := &bodyRecorder{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = recorder
+		handlerErr := next(c)
+		if handlerErr != nil {
+			c.Error(handlerErr)
+		}
+		c.Response().Writer = recorder.ResponseWriter
+
+		// レスポンスは返し終わっているので、保存に失敗してもログに出力するだけにする(キーは処理中のタイムアウト後に引き継げる)
+		ctx = context.WithoutCancel(ctx)
+		if err := h.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+			// 207を保存すると失敗した分を同じキーで再実行できなくなる
+			if status := c.Response().Status; status >= http.StatusInternalServerError || status == http.StatusMultiStatus {
+				return errors.WithStack(h.idempotencyRepo.Release(ctx, tx, scope, key))
+			}
+			record.Status = c.Response().Status
+			record.ContentType = c.Response().Header().Get(echo.HeaderContentType)
+			record.Body = recorder.body.String()
+			return errors.WithStack(h.idempotencyRepo.Complete(ctx, tx, record))
+		}, withTxName("complete_idempotency_key")); err != nil {
+			log.Printf("Idempotency-Keyのレスポンスの保存に失敗しました。: %+v\n", err)
+		}
+		return errors.WithStack(handlerErr)
+	}
+}
@@ -82,7 +82,8 @@ func runLoadTest(
 					workers.Done()
 				}()
 
-				reqCtx := context.Background()
+				// 集計用の値は引き継ぎ、キャンセルは伝播させない
+				reqCtx := context.WithoutCancel(ctx)
 				userName, err := userSpawnScenario.Run(reqCtx, e)
 				if err != nil {
 					errorHandler(ctx, err)
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// loadTestProfile は負荷試験を実行するバックエンド(接続設定とスキーマのdialect)とアプリケーションの設定
+type loadTestProfile struct {
+	Name          string
+	DB            *dbConfig
+	Dialect       dialect
+	IDGen         idGenerator
+	CounterShards int // お気に入り数のシャーディングカウンターの行数(0は使わない)
+}
+
+var profileEnvRegexp = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// profileEnvPrefix はプロファイル毎の環境変数の接頭辞を返す ex) dsql-tokyo -> PROFILE_DSQL_TOKYO_
+func profileEnvPrefix(name string) string {
+	return "PROFILE_" + profileEnvRegexp.ReplaceAllString(strings.ToUpper(name), "_") + "_"
+}
+
+// loadTestProfilesFromEnv は APP_PROFILES にカンマ区切りで指定したプロファイルを返す
+// プロファイル毎の接続設定は PROFILE_<NAME>_DB_HOST のように DB_* に接頭辞を付けて指定する
+// IDの発行方式とシャーディングカウンターも PROFILE_<NAME>_APP_ID_STRATEGY、PROFILE_<NAME>_APP_FAVORITE_COUNTER_SHARDS で上書きできる
+// APP_PROFILES が無ければ DB_* の接続設定を1つのプロファイルとする
+// DB_DRIVER にカンマ区切りで複数指定したプロファイルはドライバー毎に分ける
+func loadTestProfilesFromEnv() ([]*loadTestProfile, error) {
+	names := make([]string, 0)
+	for _, name := range strings.Split(os.Getenv("APP_PROFILES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, "")
+	}
+
+	profiles := make([]*loadTestProfile, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		prefix := ""
+		if name != "" {
+			prefix = profileEnvPrefix(name)
+		}
+		base := dbConfigFromEnvPrefix(prefix)
+		d, err := parseDialect(base.Dialect)
+		if err != nil {
+			return nil, errors.Wrapf(err, "プロファイル %s", name)
+		}
+		drivers := strings.Split(base.Driver, ",")
+		for _, driver := range drivers {
+			driver = strings.TrimSpace(driver)
+			if driver == "" {
+				driver = driverPQ
+			}
+			conf := *base
+			conf.Driver = driver
+			runName := name
+			if runName == "" {
+				runName = driver
+			} else if len(drivers) > 1 {
+				runName = name + "/" + driver
+			}
+			if seen[runName] {
+				return nil, errors.Newf("プロファイルが重複しています。: %s", runName)
+			}
+			seen[runName] = true
+			idGen, err := newIDGeneratorFromEnvPrefix(prefix)
+			if err != nil {
+				return nil, errors.Wrapf(err, "プロファイル %s", name)
+			}
+			counterShards, err := favoriteCounterShardsFromEnvPrefix(prefix)
+			if err != nil {
+				return nil, errors.Wrapf(err, "プロファイル %s", name)
+			}
+			profiles = append(profiles, &loadTestProfile{Name: runName, DB: &conf, Dialect: d, IDGen: idGen, CounterShards: counterShards})
+		}
+	}
+	return profiles, nil
+}
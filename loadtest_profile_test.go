@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_loadTestProfilesFromEnv(t *testing.T) {
+	t.Setenv("DB_HOST", "localhost")
+	t.Setenv("DB_USER", "postgres")
+	t.Setenv("DB_DRIVER", "")
+	t.Setenv("DB_DIALECT", "")
+	t.Setenv("APP_PROFILES", "postgres, dsql-tokyo")
+	t.Setenv("PROFILE_POSTGRES_DB_DRIVER", "pq,pgx")
+	t.Setenv("PROFILE_DSQL_TOKYO_DB_HOST", "example.dsql.ap-northeast-1.on.aws")
+	t.Setenv("PROFILE_DSQL_TOKYO_DB_USER", "admin")
+	t.Setenv("PROFILE_DSQL_TOKYO_DB_DIALECT", "dsql")
+
+	profiles, err := loadTestProfilesFromEnv()
+	require.NoError(t, err)
+	require.Len(t, profiles, 3)
+
+	require.Equal(t, "postgres/pq", profiles[0].Name)
+	require.Equal(t, driverPQ, profiles[0].DB.Driver)
+	require.Equal(t, "postgres/pgx", profiles[1].Name)
+	require.Equal(t, driverPgx, profiles[1].DB.Driver)
+	require.Equal(t, dialectPostgres, profiles[1].Dialect)
+	require.Equal(t, "localhost", profiles[1].DB.Host)
+
+	// プロファイルに無い設定は DB_* の値を使う
+	require.Equal(t, "dsql-tokyo", profiles[2].Name)
+	require.Equal(t, dialectDSQL, profiles[2].Dialect)
+	require.Equal(t, "example.dsql.ap-northeast-1.on.aws", profiles[2].DB.Host)
+	require.Equal(t, "admin", profiles[2].DB.User)
+	require.Equal(t, driverPQ, profiles[2].DB.Driver)
+
+	t.Setenv("APP_PROFILES", "")
+	t.Setenv("DB_DRIVER", "pq,pgx")
+	profiles, err = loadTestProfilesFromEnv()
+	require.NoError(t, err)
+	require.Len(t, profiles, 2)
+	require.Equal(t, "pq", profiles[0].Name)
+	require.Equal(t, "pgx", profiles[1].Name)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// loadTestStats は負荷試験のリクエスト結果をエンドポイント毎に集計する
+type loadTestStats struct {
+	mu        sync.Mutex
+	start     time.Time
+	end       time.Time
+	endpoints map[string]*endpointStats
+}
+
+type endpointStats struct {
+	latencies    []time.Duration
+	clientErrors int // 4xx
+	serverErrors int // 5xx
+}
+
+func newLoadTestStats() *loadTestStats {
+	return &loadTestStats{endpoints: make(map[string]*endpointStats)}
+}
+
+type loadTestStatsKey struct{}
+
+func withLoadTestStats(ctx context.Context, stats *loadTestStats) context.Context {
+	return context.WithValue(ctx, loadTestStatsKey{}, stats)
+}
+
+func loadTestStatsFromContext(ctx context.Context) *loadTestStats {
+	stats, _ := ctx.Value(loadTestStatsKey{}).(*loadTestStats)
+	return stats
+}
+
+// endpointName はルーティングのパスパターンでエンドポイント名を返す(パスパラメーター毎に分かれないようにする)
+func endpointName(e *echo.Echo, req *http.Request) string {
+	c := e.NewContext(req, nil)
+	e.Router().Find(req.Method, req.URL.Path, c)
+	path := c.Path()
+	if path == "" {
+		path = req.URL.Path
+	}
+	return req.Method + " " + path
+}
+
+func (s *loadTestStats) record(endpoint string, latency time.Duration, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.start.IsZero() || now.Add(-latency).Before(s.start) {
+		s.start = now.Add(-latency)
+	}
+	if now.After(s.end) {
+		s.end = now
+	}
+	es, ok := s.endpoints[endpoint]
+	if !ok {
+		es = &endpointStats{}
+		s.endpoints[endpoint] = es
+	}
+	es.latencies = append(es.latencies, latency)
+	switch {
+	case status >= http.StatusInternalServerError:
+		es.serverErrors++
+	case status >= http.StatusBadRequest:
+		es.clientErrors++
+	}
+}
+
+// endpointSummary はエンドポイント毎の集計結果
+type endpointSummary struct {
+	Endpoint     string
+	Count        int
+	ClientErrors int
+	ServerErrors int
+	P50          time.Duration
+	P90          time.Duration
+	P99          time.Duration
+	Max          time.Duration
+	RPS          float64
+}
+
+func (s *loadTestStats) elapsed() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.end.Sub(s.start)
+}
+
+// summary はエンドポイント名の順に集計結果を返す
+func (s *loadTestStats) summary() []*endpointSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := s.end.Sub(s.start).Seconds()
+	summaries := make([]*endpointSummary, 0, len(s.endpoints))
+	for endpoint, es := range s.endpoints {
+		latencies := append([]time.Duration(nil), es.latencies...)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		summary := &endpointSummary{
+			Endpoint:     endpoint,
+			Count:        len(latencies),
+			ClientErrors: es.clientErrors,
+			ServerErrors: es.serverErrors,
+			P50:          percentile(latencies, 50),
+			P90:          percentile(latencies, 90),
+			P99:          percentile(latencies, 99),
+			Max:          percentile(latencies, 100),
+		}
+		if elapsed > 0 {
+			summary.RPS = float64(summary.Count) / elapsed
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Endpoint < summaries[j].Endpoint })
+	return summaries
+}
+
+// percentile はソート済みのレイテンシーからnearest-rank法でパーセンタイル値を返す
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// loadTestRun は比較する負荷試験の1回分の結果
+type loadTestRun struct {
+	Profile *loadTestProfile
+	Stats   *loadTestStats
+}
+
+// printLoadTestReport は各実行のバックエンドと、エンドポイント毎に各実行の結果を並べて出力する
+func printLoadTestReport(w io.Writer, seed int64, runs []*loadTestRun) error {
+	summaries := make([]map[string]*endpointSummary, len(runs))
+	endpoints := make([]string, 0)
+	seen := make(map[string]bool)
+	for i, run := range runs {
+		summaries[i] = make(map[string]*endpointSummary)
+		for _, summary := range run.Stats.summary() {
+			summaries[i][summary.Endpoint] = summary
+			if !seen[summary.Endpoint] {
+				seen[summary.Endpoint] = true
+				endpoints = append(endpoints, summary.Endpoint)
+			}
+		}
+	}
+	sort.Strings(endpoints)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "seed: %d\n\n", seed)
+	fmt.Fprintln(tw, strings.Join([]string{"run", "dialect", "driver", "id_strategy", "counter_shards", "host", "duration"}, "\t"))
+	for _, run := range runs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			run.Profile.Name, run.Profile.Dialect, run.Profile.DB.Driver, run.Profile.IDGen.Strategy(), run.Profile.CounterShards, run.Profile.DB.Host,
+			run.Stats.elapsed().Round(time.Millisecond))
+	}
+	fmt.Fprintln(tw)
+
+	header := []string{"endpoint", "run", "count", "4xx", "5xx", "p50", "p90", "p99", "max", "rps"}
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, endpoint := range endpoints {
+		for i, run := range runs {
+			summary, ok := summaries[i][endpoint]
+			if !ok {
+				summary = &endpointSummary{}
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%.1f\n",
+				endpoint, run.Profile.Name, summary.Count, summary.ClientErrors, summary.ServerErrors,
+				summary.P50.Round(time.Microsecond), summary.P90.Round(time.Microsecond),
+				summary.P99.Round(time.Microsecond), summary.Max.Round(time.Microsecond), summary.RPS)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_loadTestStats(t *testing.T) {
+	e := setupEcho(newMemoryHandler())
+	stats := newLoadTestStats()
+	ctx := withLoadTestStats(context.Background(), stats)
+
+	_, err := doLoadTestRequest(ctx, e, "", http.MethodPost, "/user", `{"name":"stats","email":"stats@email.com","password":"stats"}`)
+	require.NoError(t, err)
+	for _, id := range []string{"a", "b"} {
+		_, err := doLoadTestRequest(ctx, e, "stats", http.MethodGet, "/article/"+id, "")
+		require.NoError(t, err)
+	}
+
+	summaries := stats.summary()
+	require.Len(t, summaries, 2)
+	// パスパラメーターが違ってもルーティングのパターンで集計される
+	require.Equal(t, "GET /article/:article_id", summaries[0].Endpoint)
+	require.Equal(t, 2, summaries[0].Count)
+	require.Equal(t, 2, summaries[0].ClientErrors)
+	require.Equal(t, "POST /user", summaries[1].Endpoint)
+	require.Equal(t, 1, summaries[1].Count)
+	require.Equal(t, 0, summaries[1].ClientErrors+summaries[1].ServerErrors)
+}
+
+func Test_percentile(t *testing.T) {
+	latencies := make([]time.Duration, 0, 100)
+	for i := 1; i <= 100; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	require.Equal(t, 50*time.Millisecond, percentile(latencies, 50))
+	require.Equal(t, 99*time.Millisecond, percentile(latencies, 99))
+	require.Equal(t, 100*time.Millisecond, percentile(latencies, 100))
+	require.Equal(t, time.Duration(0), percentile(nil, 50))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"math/rand"
 	"net"
@@ -17,7 +18,26 @@ import (
 
 func main() {
 	log.Println("Starting...")
-	if err := run(os.Getenv("APP_IS_SERVER_MODE") == "true"); err != nil {
+	run := func() error {
+		return run(os.Getenv("APP_IS_SERVER_MODE") == "true")
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			run = func() error {
+				return runMigrateCommand(os.Args[2:])
+			}
+		case "reconcile":
+			run = func() error {
+				return runReconcileCommand(os.Args[2:])
+			}
+		case "sweep":
+			run = func() error {
+				return runSweepCommand(os.Args[2:])
+			}
+		}
+	}
+	if err := run(); err != nil {
 		log.Printf("%+v\n", err)
 		os.Exit(1)
 	}
@@ -25,6 +45,122 @@ func main() {
 	os.Exit(0)
 }
 
+// runMigrateCommand は migrate <up|status|render> を実行する
+// DB_DIALECT に postgres, dsql, limitless のいずれかを指定する
+func runMigrateCommand(args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if len(args) != 1 {
+		return errors.New("使い方: migrate <up|status|render>")
+	}
+	conf := dbConfigFromEnv()
+	d, err := parseDialect(conf.Dialect)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if args[0] == "render" {
+		return errors.WithStack(runMigrate(ctx, nil, d, args[0]))
+	}
+
+	conn, _, err := newConnectionFromConfig(conf, conf.Host)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+	return errors.WithStack(runMigrate(ctx, conn, d, args[0]))
+}
+
+// runReconcileCommand は reconcile [-dry-run] [-batch-size N] を実行し、お気に入り数を users_articles の件数から数え直す
+func runReconcileCommand(args []string) (err error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "ずれを報告するだけで修正しない")
+	batchSize := fs.Int("batch-size", 1000, "1回に確認する記事数")
+	if err := fs.Parse(args); err != nil {
+		return errors.WithStack(err)
+	}
+
+	otelShutdown, err := setupOTelSDK(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		err = errors.Join(err, otelShutdown(context.Background()))
+	}()
+
+	counterShards, err := favoriteCounterShardsFromEnvPrefix("")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	db, err := newDBExt(dbConfigFromEnv())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer db.Close()
+	r := &favoriteCountReconciler{
+		db:           db,
+		articleRepo:  &sqlArticleRepository{db: db, counterShards: counterShards},
+		favoriteRepo: &sqlFavoriteRepository{db: db},
+		timer:        &timerImpl{},
+		batchSize:    *batchSize,
+		dryRun:       *dryRun,
+	}
+	result, err := r.Run(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	log.Printf("お気に入り数を数え直しました。: checked=%d drifted=%d corrected=%d", result.Checked, result.Drifted, result.Corrected)
+	return nil
+}
+
+// runSweepCommand は sweep [-dry-run] [-batch-size N] [-max-batches N] を実行し、外部キーの無いバックエンドで孤立した行を削除する
+func runSweepCommand(args []string) (err error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fs := flag.NewFlagSet("sweep", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "孤立した行を報告するだけで削除しない")
+	batchSize := fs.Int("batch-size", 100, "1つのトランザクションで削除する行数")
+	maxBatches := fs.Int("max-batches", 0, "種類毎に処理するバッチ数の上限(0は無制限)")
+	if err := fs.Parse(args); err != nil {
+		return errors.WithStack(err)
+	}
+
+	otelShutdown, err := setupOTelSDK(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		err = errors.Join(err, otelShutdown(context.Background()))
+	}()
+
+	conf := dbConfigFromEnv()
+	conf.Role = dbRoleSweeper
+	db, err := newDBExt(conf)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer db.Close()
+	s := &orphanSweeper{
+		db:              db,
+		orphanRepo:      &sqlOrphanRepository{db: db},
+		batchSize:       *batchSize,
+		maxBatches:      *maxBatches,
+		dryRun:          *dryRun,
+		idempotencyRepo: &sqlIdempotencyRepository{db: db},
+		timer:           &timerImpl{},
+	}
+	results, err := s.Run(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	logSweepResults(results)
+	return nil
+}
+
 func run(isServerMode bool) error {
 	// Handle SIGINT (CTRL+C) gracefully.
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
@@ -41,58 +177,36 @@ func run(isServerMode bool) error {
 	}()
 
 	if !isServerMode {
-		conn, err := newConnection(
-			os.Getenv("DB_HOST"), os.Getenv("DB_PORT"), os.Getenv("DB_USER"),
-			os.Getenv("DB_PASS"), os.Getenv("DB_NAME"), os.Getenv("DB_SSL"),
-		)
+		conf, err := loadTestConfigFromEnv()
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		log.Println("Ping to DB.")
-		if err := conn.PingContext(ctx); err != nil {
-			return errors.WithStack(err)
-		}
-		log.Println("Connected to DB.")
-		randUtilImplInstance := &randUtilImpl{
-			Rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+		seed := time.Now().UnixNano()
+		if v := os.Getenv("APP_SEED"); v != "" {
+			if seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return errors.WithStack(err)
+			}
 		}
-		h := &handler{
-			db:       &dbExt{conn},
-			randUtil: randUtilImplInstance,
-			timer:    &timerImpl{},
-		}
-
-		e := setupEcho(h)
-
-		duration, err := strconv.ParseInt(os.Getenv("APP_DURATION"), 10, 64)
-		if err != nil {
-			return errors.WithStack(err)
-		}
-		users, err := strconv.ParseInt(os.Getenv("APP_USERS"), 10, 64)
-		if err != nil {
-			return errors.WithStack(err)
-		}
-		spawnRate, err := strconv.ParseInt(os.Getenv("APP_SPAWN_RATE"), 10, 64)
+		// APP_PROFILES に指定したバックエンド毎に、同じシナリオとシードで順に実行して結果を比較する
+		profiles, err := loadTestProfilesFromEnv()
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		migrate := os.Getenv("APP_MIGRATE") == "true"
 
 		loadErr := make(chan error, 1)
 		go func() {
-			loadErr <- runLoadTest(
-				ctx,
-				&config{
-					Duration:  time.Duration(duration) * time.Second,
-					Users:     int32(users),
-					SpawnRate: int32(spawnRate),
-				},
-				e,
-				&initScenario{},
-				&userSpawnScenario{},
-				&articleScenario{
-					randUtil: randUtilImplInstance,
-				},
-			)
+			runs := make([]*loadTestRun, 0, len(profiles))
+			for _, profile := range profiles {
+				log.Printf("プロファイル %s の負荷試験を実行します。", profile.Name)
+				stats, err := runLoadTestProfile(ctx, profile, conf, seed, migrate)
+				if err != nil {
+					loadErr <- errors.Wrapf(err, "プロファイル %s", profile.Name)
+					return
+				}
+				runs = append(runs, &loadTestRun{Profile: profile, Stats: stats})
+			}
+			loadErr <- errors.WithStack(printLoadTestReport(os.Stdout, seed, runs))
 		}()
 
 		// Wait for interruption.
@@ -114,6 +228,28 @@ func run(isServerMode bool) error {
 		return errors.WithStack(err)
 	}
 
+	stopSweeper, err := startSweeperFromEnv(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer stopSweeper()
+
+	// アウトボックスのリレーはサーバーとは別の接続で配信する
+	if len(outboxSinksFromEnv()) > 0 {
+		conf := dbConfigFromEnv()
+		conf.Role = dbRoleOutbox
+		db, err := newDBExt(conf)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer db.Close()
+		stopRelays, err := startOutboxRelaysFromEnv(ctx, db, &sqlOutboxRepository{db: db})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer stopRelays()
+	}
+
 	srv := &http.Server{
 		Addr:         ":8080",
 		BaseContext:  func(_ net.Listener) context.Context { return ctx },
@@ -145,3 +281,98 @@ func run(isServerMode bool) error {
 	}
 	return nil
 }
+
+func loadTestConfigFromEnv() (*config, error) {
+	duration, err := strconv.ParseInt(os.Getenv("APP_DURATION"), 10, 64)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	users, err := strconv.ParseInt(os.Getenv("APP_USERS"), 10, 64)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	spawnRate, err := strconv.ParseInt(os.Getenv("APP_SPAWN_RATE"), 10, 64)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &config{
+		Duration:  time.Duration(duration) * time.Second,
+		Users:     int32(users),
+		SpawnRate: int32(spawnRate),
+	}, nil
+}
+
+// runLoadTestProfile は profile のバックエンドに接続して負荷試験を実行し、集計結果を返す
+// migrate が true の場合は負荷試験の前に profile のdialectでマイグレーションを適用する
+func runLoadTestProfile(ctx context.Context, profile *loadTestProfile, conf *config, seed int64, migrate bool) (*loadTestStats, error) {
+	db, err := newDBExt(profile.DB)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer db.Close()
+	log.Println("Ping to DB.")
+	if err := db.PingContext(ctx); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	log.Println("Connected to DB.")
+	if migrate {
+		m, err := newMigrator(db.db, profile.Dialect)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err := m.Up(ctx); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	randUtilImplInstance := &randUtilImpl{
+		Rand: rand.New(rand.NewSource(seed)),
+	}
+	h := newSQLHandler(db, profile.IDGen, &timerImpl{}, profile.CounterShards)
+	if h.idempotencyTTL, err = idempotencyTTLFromEnv(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if h.idempotencyProcessingTimeout, err = idempotencyProcessingTimeoutFromEnv(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if len(outboxSinksFromEnv()) > 0 {
+		h.outboxRepo = &sqlOutboxRepository{db: db}
+	}
+	if h.queryBudget, err = queryBudgetFromEnv(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if h.articleBatchMax, err = articleBatchMaxFromEnv(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if h.favoriteDuplicates, err = favoriteDuplicateModeFromEnv(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	stopRelays, err := startOutboxRelaysFromEnv(ctx, db, &sqlOutboxRepository{db: db})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer stopRelays()
+
+	e := setupEcho(h)
+
+	retry, err := loadTestClientRetryFromEnv()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	stats := newLoadTestStats()
+	if err := runLoadTest(
+		withLoadTestClientRetry(withLoadTestStats(ctx, stats), retry),
+		conf,
+		e,
+		&initScenario{},
+		&userSpawnScenario{},
+		&articleScenario{
+			randUtil:         randUtilImplInstance,
+			conflictingEdits: os.Getenv("APP_SCENARIO_CONFLICTING_EDITS") == "true",
+			hotFavorites:     os.Getenv("APP_SCENARIO_HOT_FAVORITES") == "true",
+		},
+	); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+// dialect はスキーマを適用するバックエンドの種類
+type dialect string
+
+const (
+	dialectPostgres  dialect = "postgres"
+	dialectDSQL      dialect = "dsql"
+	dialectLimitless dialect = "limitless"
+)
+
+func parseDialect(s string) (dialect, error) {
+	switch d := dialect(s); d {
+	case "":
+		return dialectPostgres, nil
+	case dialectPostgres, dialectDSQL, dialectLimitless:
+		return d, nil
+	}
+	return "", errors.Newf("未対応のDB_DIALECTです。: %s", s)
+}
+
+// ForeignKeys は外部キー制約を作成するかどうか(DSQLは外部キーをサポートしていない)
+func (d dialect) ForeignKeys() bool {
+	return d != dialectDSQL
+}
+
+// AddColumnConstraints は ALTER TABLE ADD COLUMN で NOT NULL や DEFAULT を指定できるかどうか(DSQLは指定できない)
+func (d dialect) AddColumnConstraints() bool {
+	return d != dialectDSQL
+}
+
+// Savepoints はトランザクション内でセーブポイントを使えるかどうか(DSQLはサポートしていない)
+func (d dialect) Savepoints() bool {
+	return d != dialectDSQL
+}
+
+// TransactionalDDL はマイグレーション毎にDDLを1つのトランザクションで適用できるかどうか
+// DSQLは1トランザクションで1つのDDLしか実行できず、Limitlessはシャーディングテーブルへの変換を含むため、文毎に実行する
+func (d dialect) TransactionalDDL() bool {
+	return d == dialectPostgres
+}
+
+// dsqlMaxRowsPerTransaction はDSQLの1トランザクションで変更できる行数の上限
+const dsqlMaxRowsPerTransaction = 3000
+
+// MaxRowsPerTransaction は1トランザクションで変更できる行数の上限(0は無制限)
+func (d dialect) MaxRowsPerTransaction() int {
+	if d == dialectDSQL {
+		return dsqlMaxRowsPerTransaction
+	}
+	return 0
+}
+
+// Sharded はテーブルをシャーディングするかどうか
+func (d dialect) Sharded() bool {
+	return d == dialectLimitless
+}
+
+func (d dialect) funcMap() template.FuncMap {
+	return template.FuncMap{
+		// shardTable はLimitlessの場合のみテーブルをシャーディングテーブルにする
+		"shardTable": func(table string, keys ...string) string {
+			if !d.Sharded() {
+				return ""
+			}
+			return fmt.Sprintf("CALL rds_aurora.limitless_alter_table_type_sharded('%s', ARRAY['%s']);", table, strings.Join(keys, "', '"))
+		},
+		// createIndex はDSQLの場合は非同期でインデックスを作成する
+		"createIndex": func(name, table string, columns ...string) string {
+			async := ""
+			if d == dialectDSQL {
+				async = " ASYNC"
+			}
+			return fmt.Sprintf(`CREATE INDEX%s IF NOT EXISTS "%s" ON %s ("%s");`, async, name, table, strings.Join(columns, `", "`))
+		},
+		// backfill は where に一致する行を set で更新する
+		// 1トランザクションで変更できる行数に上限があるバックエンド(DSQL)では、上限までの行を更新する文を更新する行が無くなるまで繰り返す
+		"backfill": func(table, key, set, where string) string {
+			limit := d.MaxRowsPerTransaction()
+			if limit <= 0 {
+				return fmt.Sprintf(`UPDATE %s SET %s WHERE %s;`, table, set, where)
+			}
+			return fmt.Sprintf("%s\nUPDATE %s SET %s WHERE \"%s\" IN (SELECT \"%s\" FROM %s WHERE %s LIMIT %d);",
+				repeatDirective, table, set, key, key, table, where, limit)
+		},
+	}
+}
+
+// repeatDirective を先頭のコメントに付けた文は、更新する行が無くなるまで繰り返し実行する
+const repeatDirective = "-- migrate:repeat"
+
+// migration は migrations/<version>_<name>.sql に置いたスキーマ変更
+// ファイルはtext/templateで、dialect毎にDDLを出し分ける
+type migration struct {
+	version int64
+	name    string
+	body    string
+}
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.sql$`)
+
+func loadMigrations() ([]*migration, error) {
+	entries, err := fs.ReadDir(migrationFS, "migrations")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	migrations := make([]*migration, 0, len(entries))
+	versions := make(map[int64]string)
+	for _, entry := range entries {
+		m := migrationFileRegexp.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, errors.Newf("マイグレーションのファイル名が不正です。: %s", entry.Name())
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if dup, ok := versions[version]; ok {
+			return nil, errors.Newf("マイグレーションのバージョンが重複しています。: %s, %s", dup, entry.Name())
+		}
+		versions[version] = entry.Name()
+		body, err := fs.ReadFile(migrationFS, path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		migrations = append(migrations, &migration{version: version, name: m[2], body: string(body)})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// render はdialect向けのDDLを1文ずつに分割して返す
+// DSQLは1トランザクションで1つのDDLしか実行できないため、文毎に実行する
+func (m *migration) render(d dialect) ([]string, error) {
+	tmpl, err := template.New(m.name).Funcs(d.funcMap()).Parse(m.body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, d); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	statements := make([]string, 0)
+	for _, chunk := range strings.Split(buf.String(), ";\n") {
+		statement := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(chunk), ";"))
+		if isCommentOnly(statement) {
+			continue
+		}
+		statements = append(statements, statement)
+	}
+	return statements, nil
+}
+
+// hasDirective は文の先頭のコメントに directive があるかどうかを返す
+func hasDirective(statement, directive string) bool {
+	for _, line := range strings.Split(statement, "\n") {
+		line = strings.TrimSpace(line)
+		if line == directive {
+			return true
+		}
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+	return false
+}
+
+func isCommentOnly(statement string) bool {
+	return stripLeadingComments(statement) == ""
+}
+
+func stripLeadingComments(statement string) string {
+	lines := strings.Split(statement, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return strings.TrimSpace(strings.Join(lines[i:], "\n"))
+		}
+	}
+	return ""
+}
+
+type migrator struct {
+	db         *sql.DB
+	dialect    dialect
+	migrations []*migration
+}
+
+func newMigrator(db *sql.DB, d dialect) (*migrator, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &migrator{db: db, dialect: d, migrations: migrations}, nil
+}
+
+func (m *migrator) ensureTable(ctx context.Context) error {
+	if _, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS public."schema_migrations"
+(
+    "version"    bigint    NOT NULL,
+    "name"       varchar   NOT NULL,
+    "applied_at" timestamp NOT NULL,
+    PRIMARY KEY ("version")
+)`); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (m *migrator) appliedVersions(ctx context.Context) (map[int64]time.Time, error) {
+	rows, err := m.db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		applied[version] = appliedAt
+	}
+	return applied, errors.WithStack(rows.Err())
+}
+
+// Up は未適用のマイグレーションを順に適用する
+// Postgresはマイグレーション毎に文と schema_migrations への記録を1つのトランザクションで適用し、途中で失敗した場合は何も適用しない
+// それ以外はDDLが文毎にコミットされるため、途中で失敗した場合は IF NOT EXISTS で再実行できるようにしておく
+func (m *migrator) Up(ctx context.Context) error {
+	if err := m.ensureTable(ctx); err != nil {
+		return errors.WithStack(err)
+	}
+	applied, err := m.appliedVersions(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.version]; ok {
+			continue
+		}
+		statements, err := mig.render(m.dialect)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		log.Printf("マイグレーションを適用します。: %d_%s (%s)", mig.version, mig.name, m.dialect)
+		if m.dialect.TransactionalDDL() {
+			err = m.applyInTransaction(ctx, mig, statements)
+		} else {
+			err = m.apply(ctx, m.db, mig, statements)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "マイグレーションに失敗しました。: %d_%s", mig.version, mig.name)
+		}
+	}
+	return nil
+}
+
+// migrationExecer は *sql.DB か *sql.Tx
+type migrationExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// applyInTransaction はマイグレーションの文と schema_migrations への記録を1つのトランザクションで適用する
+func (m *migrator) applyInTransaction(ctx context.Context, mig *migration, statements []string) (err error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, tx.Rollback())
+		}
+	}()
+	if err := m.apply(ctx, tx, mig, statements); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(tx.Commit())
+}
+
+// apply はマイグレーションの文を順に実行し、schema_migrations に記録する
+func (m *migrator) apply(ctx context.Context, ex migrationExecer, mig *migration, statements []string) error {
+	for _, statement := range statements {
+		if err := m.exec(ctx, ex, statement); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	_, err := ex.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+		mig.version, mig.name, time.Now().UTC())
+	return errors.WithStack(err)
+}
+
+func (m *migrator) exec(ctx context.Context, ex migrationExecer, statement string) error {
+	if hasDirective(statement, repeatDirective) {
+		// 文毎にコミットされるので、1トランザクションで変更する行数は文の LIMIT までになる
+		for {
+			result, err := ex.ExecContext(ctx, statement)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if n == 0 {
+				return nil
+			}
+		}
+	}
+	if !strings.HasPrefix(stripLeadingComments(statement), "CREATE INDEX ASYNC") {
+		_, err := ex.ExecContext(ctx, statement)
+		return errors.WithStack(err)
+	}
+	// DSQLの非同期インデックス作成はジョブIDを返すので完了まで待つ
+	var jobID string
+	if err := ex.QueryRowContext(ctx, statement).Scan(&jobID); err != nil {
+		return errors.WithStack(err)
+	}
+	log.Printf("インデックスの作成完了を待ちます。: job_id=%s", jobID)
+	var ok bool
+	if err := ex.QueryRowContext(ctx, "SELECT sys.wait_for_job($1)", jobID).Scan(&ok); err != nil {
+		return errors.WithStack(err)
+	}
+	if !ok {
+		return errors.Newf("インデックスの作成に失敗しました。: job_id=%s", jobID)
+	}
+	return nil
+}
+
+type migrationStatus struct {
+	version   int64
+	name      string
+	appliedAt *time.Time
+}
+
+// Status は全てのマイグレーションと適用日時を返す
+func (m *migrator) Status(ctx context.Context) ([]*migrationStatus, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	applied, err := m.appliedVersions(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	statuses := make([]*migrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		status := &migrationStatus{version: mig.version, name: mig.name}
+		if appliedAt, ok := applied[mig.version]; ok {
+			status.appliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// runMigrate は migrate <up|status|render> を実行する
+func runMigrate(ctx context.Context, db *sql.DB, d dialect, command string) error {
+	m, err := newMigrator(db, d)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	switch command {
+	case "up":
+		return errors.WithStack(m.Up(ctx))
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.appliedAt != nil {
+				appliedAt = status.appliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.version, status.name, appliedAt)
+		}
+		return nil
+	case "render":
+		for _, mig := range m.migrations {
+			statements, err := mig.render(d)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			fmt.Printf("-- %04d_%s\n", mig.version, mig.name)
+			for _, statement := range statements {
+				fmt.Printf("%s;\n\n", statement)
+			}
+		}
+		return nil
+	}
+	return errors.Newf("未対応のコマンドです。: migrate %s", command)
+}
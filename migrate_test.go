@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_migration_render(t *testing.T) {
+	migrations, err := loadMigrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	render := func(d dialect) string {
+		all := make([]string, 0)
+		for _, m := range migrations {
+			statements, err := m.render(d)
+			require.NoError(t, err)
+			all = append(all, statements...)
+		}
+		return strings.Join(all, ";\n")
+	}
+
+	/* Postgres */
+	ddl := render(dialectPostgres)
+	require.Contains(t, ddl, `FOREIGN KEY ("user_id") REFERENCES "users" ("id")`)
+	require.Contains(t, ddl, `UNIQUE ("email")`)
+	require.Contains(t, ddl, `CREATE INDEX IF NOT EXISTS "articles_created_at_idx"`)
+	require.NotContains(t, ddl, "limitless_alter_table_type_sharded")
+	require.Contains(t, ddl, `ADD COLUMN IF NOT EXISTS "version" bigint NOT NULL DEFAULT 1`)
+	require.Contains(t, ddl, `CREATE TABLE IF NOT EXISTS public."article_favorite_counters"`)
+	require.Contains(t, ddl, `CREATE TABLE IF NOT EXISTS public."idempotency_keys"`)
+	require.Contains(t, ddl, `CREATE INDEX IF NOT EXISTS "outbox_events_created_at_id_idx" ON public.outbox_events ("created_at", "id")`)
+	require.Contains(t, ddl, `CREATE INDEX IF NOT EXISTS "articles_total_favorite_count_id_idx" ON public.articles ("total_favorite_count", "id")`)
+	require.Contains(t, ddl, `CREATE TABLE IF NOT EXISTS public."outbox_deliveries"`)
+
+	/* DSQL */
+	ddl = render(dialectDSQL)
+	require.NotContains(t, ddl, "FOREIGN KEY")
+	require.Contains(t, ddl, `CREATE INDEX ASYNC IF NOT EXISTS "articles_created_at_idx"`)
+	require.Contains(t, ddl, `CREATE INDEX ASYNC IF NOT EXISTS "users_articles_article_id_idx"`)
+	require.Contains(t, ddl, `CREATE INDEX ASYNC IF NOT EXISTS "outbox_events_created_at_id_idx"`)
+	require.NotContains(t, ddl, "limitless_alter_table_type_sharded")
+	require.NotContains(t, ddl, "DEFAULT 1")
+	require.Contains(t, ddl, repeatDirective+`
+UPDATE public."articles" SET "version" = 1 WHERE "id" IN (SELECT "id" FROM public."articles" WHERE "version" IS NULL LIMIT 3000)`)
+
+	/* Limitless */
+	ddl = render(dialectLimitless)
+	require.Contains(t, ddl, `UNIQUE ("id", "email")`)
+	require.Contains(t, ddl, "CALL rds_aurora.limitless_alter_table_type_sharded('public.users_articles', ARRAY['user_id', 'article_id'])")
+	require.Contains(t, ddl, `FOREIGN KEY ("article_id") REFERENCES "articles" ("id")`)
+	require.Contains(t, ddl, "CALL rds_aurora.limitless_alter_table_type_sharded('public.article_favorite_counters', ARRAY['article_id', 'shard'])")
+	require.Contains(t, ddl, "CALL rds_aurora.limitless_alter_table_type_sharded('public.idempotency_keys', ARRAY['scope', 'idempotency_key'])")
+	require.Contains(t, ddl, `ADD COLUMN IF NOT EXISTS "version" bigint NOT NULL DEFAULT 1`)
+
+	/* Postgresだけマイグレーション毎に1つのトランザクションで適用する */
+	require.True(t, dialectPostgres.TransactionalDDL())
+	require.False(t, dialectDSQL.TransactionalDDL())
+	require.False(t, dialectLimitless.TransactionalDDL())
+
+	/* DSQLは1トランザクション1DDLのため文毎に分割する */
+	statements, err := migrations[0].render(dialectDSQL)
+	require.NoError(t, err)
+	require.Len(t, statements, 3)
+}
@@ -7,11 +7,14 @@ CREATE TABLE IF NOT EXISTS public."users"
     "created_at"    timestamp NOT NULL,
     "updated_at"    timestamp NOT NULL,
     PRIMARY KEY ("id"),
+{{- if .Sharded }}
+-- シャーディングされたテーブルの一意制約にはシャードキーを含める必要がある
     UNIQUE ("id", "email")
--- ERROR:  unique constraint on sharded table must include all sharded key columns
--- HINT:  UNIQUE constraint on table "public.users" lacks column "id" which is part of the shard key
+{{- else }}
+    UNIQUE ("email")
+{{- end }}
 );
-CALL rds_aurora.limitless_alter_table_type_sharded('public.users', ARRAY['id']);
+{{ shardTable "public.users" "id" }}
 
 CREATE TABLE IF NOT EXISTS public."articles"
 (
@@ -22,10 +25,12 @@ CREATE TABLE IF NOT EXISTS public."articles"
     "total_favorite_count" bigint    NOT NULL,
     "created_at"           timestamp NOT NULL,
     "updated_at"           timestamp NOT NULL,
-    PRIMARY KEY ("id"),
+    PRIMARY KEY ("id")
+{{- if .ForeignKeys }},
     FOREIGN KEY ("user_id") REFERENCES "users" ("id")
+{{- end }}
 );
-CALL rds_aurora.limitless_alter_table_type_sharded('public.articles', ARRAY['id']);
+{{ shardTable "public.articles" "id" }}
 
 CREATE TABLE IF NOT EXISTS public."users_articles"
 (
@@ -33,8 +38,10 @@ CREATE TABLE IF NOT EXISTS public."users_articles"
     "article_id" varchar   NOT NULL,
     "created_at" timestamp NOT NULL,
     "updated_at" timestamp NOT NULL,
-    PRIMARY KEY ("user_id", "article_id"),
+    PRIMARY KEY ("user_id", "article_id")
+{{- if .ForeignKeys }},
     FOREIGN KEY ("article_id") REFERENCES "articles" ("id"),
     FOREIGN KEY ("user_id") REFERENCES "users" ("id")
+{{- end }}
 );
-CALL rds_aurora.limitless_alter_table_type_sharded('public.users_articles', ARRAY['user_id', 'article_id']);
+{{ shardTable "public.users_articles" "user_id" "article_id" }}
@@ -0,0 +1,2 @@
+-- 記事一覧、お気に入り一覧の ORDER BY created_at DESC 向け
+{{ createIndex "articles_created_at_idx" "public.articles" "created_at" }}
@@ -0,0 +1,9 @@
+-- 楽観的排他制御のバージョン(更新毎に1増やす)
+{{ if .AddColumnConstraints -}}
+ALTER TABLE public."articles" ADD COLUMN IF NOT EXISTS "version" bigint NOT NULL DEFAULT 1;
+{{- else -}}
+-- DSQLは ADD COLUMN で NOT NULL や DEFAULT を指定できないので、追加後に既存の行を埋める
+-- 1トランザクションで変更できる行数に上限があるので、上限までずつ埋める
+ALTER TABLE public."articles" ADD COLUMN IF NOT EXISTS "version" bigint;
+{{ backfill `public."articles"` "id" `"version" = 1` `"version" IS NULL` }}
+{{- end }}
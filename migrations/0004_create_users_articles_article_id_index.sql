@@ -0,0 +1,2 @@
+-- 記事毎のお気に入り数の集計向け(主キーは user_id が先頭のため使えない)
+{{ createIndex "users_articles_article_id_idx" "public.users_articles" "article_id" }}
@@ -0,0 +1,14 @@
+-- お気に入り数のシャーディングカウンター(APP_FAVORITE_COUNTER_SHARDS)
+-- お気に入り数は articles.total_favorite_count とこのテーブルの count の合計
+CREATE TABLE IF NOT EXISTS public."article_favorite_counters"
+(
+    "article_id" varchar   NOT NULL,
+    "shard"      integer   NOT NULL,
+    "count"      bigint    NOT NULL,
+    "updated_at" timestamp NOT NULL,
+    PRIMARY KEY ("article_id", "shard")
+{{- if .ForeignKeys }},
+    FOREIGN KEY ("article_id") REFERENCES "articles" ("id")
+{{- end }}
+);
+{{ shardTable "public.article_favorite_counters" "article_id" "shard" }}
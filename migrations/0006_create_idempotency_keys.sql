@@ -0,0 +1,15 @@
+-- Idempotency-Key と最初のリクエストのレスポンス
+-- scope はユーザーID(認証不要のユーザー登録は空文字)、status が0の行は処理中
+CREATE TABLE IF NOT EXISTS public."idempotency_keys"
+(
+    "scope"           varchar   NOT NULL,
+    "idempotency_key" varchar   NOT NULL,
+    "request_hash"    varchar   NOT NULL,
+    "status"          integer   NOT NULL,
+    "content_type"    varchar   NOT NULL,
+    "body"            text      NOT NULL,
+    "created_at"      timestamp NOT NULL,
+    "expires_at"      timestamp NOT NULL,
+    PRIMARY KEY ("scope", "idempotency_key")
+);
+{{ shardTable "public.idempotency_keys" "scope" "idempotency_key" }}
@@ -0,0 +1,25 @@
+-- トランザクショナルアウトボックス
+-- ハンドラーが記事やお気に入りの更新と同じトランザクションでイベントを書き込み、リレーがシンクへ配信する
+CREATE TABLE IF NOT EXISTS public."outbox_events"
+(
+    "id"           varchar   NOT NULL,
+    "event_type"   varchar   NOT NULL,
+    "aggregate_id" varchar   NOT NULL,
+    "payload"      text      NOT NULL,
+    "created_at"   timestamp NOT NULL,
+    PRIMARY KEY ("id")
+);
+{{ shardTable "public.outbox_events" "id" }}
+-- リレーは (created_at, id) の順に配信し、保持期間を過ぎたイベントを created_at の範囲で探して削除する
+{{ createIndex "outbox_events_created_at_id_idx" "public.outbox_events" "created_at" "id" }}
+
+-- シンク毎に配信済みのイベント
+-- created_at の位置で読み進めると、後からコミットされたトランザクションのイベントを読み飛ばすため、配信済みのイベントを記録する
+CREATE TABLE IF NOT EXISTS public."outbox_deliveries"
+(
+    "sink"         varchar   NOT NULL,
+    "event_id"     varchar   NOT NULL,
+    "delivered_at" timestamp NOT NULL,
+    PRIMARY KEY ("event_id", "sink")
+);
+{{ shardTable "public.outbox_deliveries" "event_id" }}
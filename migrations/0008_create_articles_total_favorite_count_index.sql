@@ -0,0 +1,3 @@
+-- 記事一覧のお気に入り数の多い順(ORDER BY total_favorite_count DESC, id DESC)のキーセットページネーション向け
+-- シャーディングカウンターを使う場合はカウンターとの合計で並べるため使われない
+{{ createIndex "articles_total_favorite_count_id_idx" "public.articles" "total_favorite_count" "id" }}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	eventArticleCreated     = "article.created"
+	eventArticleUpdated     = "article.updated"
+	eventArticleDeleted     = "article.deleted"
+	eventArticleFavorited   = "article.favorited"
+	eventArticleUnfavorited = "article.unfavorited"
+)
+
+// writeEvent は変更と同じトランザクションでアウトボックスにイベントを書き込む(outboxRepo が無ければ何もしない)
+func (h *handler) writeEvent(ctx context.Context, tx *txExt, eventType, aggregateID string, payload any) error {
+	if h.outboxRepo == nil {
+		return nil
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(h.outboxRepo.Insert(ctx, tx, &OutboxEvent{
+		ID:          h.idGen.NewID(),
+		EventType:   eventType,
+		AggregateID: aggregateID,
+		Payload:     string(b),
+		CreatedAt:   h.timer.Now(),
+	}))
+}
+
+// outboxSink はイベントの配信先
+// リレーは配信後に配信済みにするため、同じイベントを複数回受け取ることがある(受け取る側はイベントのIDで重複を除く)
+type outboxSink interface {
+	Publish(ctx context.Context, events []*OutboxEvent) error
+}
+
+// outboxMessage はシンクに書き込むイベント(payload はJSONのまま埋め込む)
+type outboxMessage struct {
+	ID          string          `json:"id"`
+	EventType   string          `json:"event_type"`
+	AggregateID string          `json:"aggregate_id"`
+	Payload     json.RawMessage `json:"payload"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+func newOutboxMessages(events []*OutboxEvent) []*outboxMessage {
+	messages := make([]*outboxMessage, 0, len(events))
+	for _, e := range events {
+		messages = append(messages, &outboxMessage{
+			ID:          e.ID,
+			EventType:   e.EventType,
+			AggregateID: e.AggregateID,
+			Payload:     json.RawMessage(e.Payload),
+			CreatedAt:   e.CreatedAt,
+		})
+	}
+	return messages
+}
+
+// writeJSONL はイベントを1行1つのJSONで書き込む
+func writeJSONL(w io.Writer, events []*OutboxEvent) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, m := range newOutboxMessages(events) {
+		if err := enc.Encode(m); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return errors.WithStack(err)
+}
+
+// writerSink は標準出力などに書き込む
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerSink) Publish(_ context.Context, events []*OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.WithStack(writeJSONL(s.w, events))
+}
+
+// fileSink はJSONLファイルに追記する
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) Publish(_ context.Context, events []*OutboxEvent) (err error) {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		err = errors.Join(err, f.Close())
+	}()
+	if err := writeJSONL(f, events); err != nil {
+		return errors.WithStack(err)
+	}
+	// 配信済みにする前に書き込みを永続化する
+	return errors.WithStack(f.Sync())
+}
+
+// webhookSink はイベントの配列をJSONでPOSTする(2xx以外は失敗として再送する)
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Publish(ctx context.Context, events []*OutboxEvent) error {
+	body, err := json.Marshal(newOutboxMessages(events))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Newf("webhookの配信に失敗しました。: %s %d", s.url, res.StatusCode)
+	}
+	return nil
+}
+
+// newOutboxSink は stdout, file:<path>, webhook:<url> の形式でシンクを返す
+func newOutboxSink(spec string) (outboxSink, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "stdout":
+		return &writerSink{w: os.Stdout}, nil
+	case "file":
+		if arg == "" {
+			return nil, errors.Newf("ファイルのパスを指定してください。: %s", spec)
+		}
+		return &fileSink{path: arg}, nil
+	case "webhook":
+		if arg == "" {
+			return nil, errors.Newf("webhookのURLを指定してください。: %s", spec)
+		}
+		return &webhookSink{url: arg, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	return nil, errors.Newf("未対応のシンクです。: %s", spec)
+}
+
+var (
+	outboxPublishedCounter, _ = meter.Int64Counter(
+		"blog.outbox.published",
+		metric.WithDescription("シンクに配信したイベント数"),
+	)
+	outboxPublishErrorsCounter, _ = meter.Int64Counter(
+		"blog.outbox.publish_errors",
+		metric.WithDescription("シンクへの配信に失敗した回数"),
+	)
+	outboxPrunedCounter, _ = meter.Int64Counter(
+		"blog.outbox.pruned",
+		metric.WithDescription("全てのシンクに配信済みで保持期間を過ぎたため削除したイベント数"),
+	)
+	outboxLagGauge, _ = meter.Float64Gauge(
+		"blog.outbox.lag",
+		metric.WithDescription("未配信のイベントのうち最も古いものの経過時間"),
+		metric.WithUnit("s"),
+	)
+)
+
+// outboxRelay はアウトボックスのイベントを1つのシンクへ少なくとも1回配信する
+// シンク毎に配信済みのイベントを記録し、まだ配信していないイベントを (created_at, id) の順に配信する
+// 位置で読み進めないので、created_at より後にコミットされたトランザクションのイベントも次の実行で配信する
+type outboxRelay struct {
+	db         transactor
+	outboxRepo OutboxRepository
+	sinkName   string
+	sink       outboxSink
+	timer      timer
+	batchSize  int
+}
+
+// RunOnce は未配信のイベントを最大 batchSize 件配信し、配信した件数を返す
+func (r *outboxRelay) RunOnce(ctx context.Context) (int, error) {
+	// 配信済みの記録はライターから読む
+	ctx = withReadYourWrites(ctx)
+	attrs := metric.WithAttributes(attribute.String("sink", r.sinkName))
+
+	now := r.timer.Now()
+	events, err := r.outboxRepo.ListUndelivered(ctx, r.sinkName, r.batchSize)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if len(events) == 0 {
+		outboxLagGauge.Record(ctx, 0, attrs)
+		return 0, nil
+	}
+	outboxLagGauge.Record(ctx, now.Sub(events[0].CreatedAt).Seconds(), attrs)
+
+	if err := r.sink.Publish(ctx, events); err != nil {
+		outboxPublishErrorsCounter.Add(ctx, 1, attrs)
+		return 0, errors.WithStack(err)
+	}
+	outboxPublishedCounter.Add(ctx, int64(len(events)), attrs)
+
+	ids := make([]string, 0, len(events))
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	if err := r.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		return errors.WithStack(r.outboxRepo.MarkDelivered(ctx, tx, r.sinkName, ids, r.timer.Now()))
+	}, withTxName("mark_outbox_delivered")); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return len(events), nil
+}
+
+// Run は interval 毎に未配信のイベントを配信する(batchSize 件配信できた場合は待たずに続ける)
+func (r *outboxRelay) Run(ctx context.Context, interval time.Duration) {
+	for {
+		n, err := r.RunOnce(ctx)
+		if err != nil {
+			log.Printf("イベントの配信に失敗しました。: sink=%s %+v\n", r.sinkName, err)
+		}
+		if err == nil && n == r.batchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// defaultOutboxRetention は全てのシンクに配信済みのイベントを保持する期間のデフォルト
+const defaultOutboxRetention = time.Hour
+
+// outboxPruner は全てのシンクに配信済みで retention を過ぎたイベントと配信済みの記録を削除する
+// リレーが未配信のイベントを探す範囲と、outbox_events と outbox_deliveries の行数が増え続けないようにする
+type outboxPruner struct {
+	db         transactor
+	outboxRepo OutboxRepository
+	sinks      []string
+	timer      timer
+	retention  time.Duration
+	batchSize  int // 1トランザクションで削除するイベント数(イベント毎に配信済みの記録をシンクの数だけ削除する)
+}
+
+// RunOnce は削除できるイベントを最大 batchSize 件削除し、削除した件数を返す
+func (p *outboxPruner) RunOnce(ctx context.Context) (int, error) {
+	// 配信済みの記録はライターから読む
+	ctx = withReadYourWrites(ctx)
+	ids, err := p.outboxRepo.ListDelivered(ctx, p.sinks, p.timer.Now().Add(-p.retention), p.batchSize)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	if err := p.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		return errors.WithStack(p.outboxRepo.DeleteEvents(ctx, tx, ids))
+	}, withTxName("prune_outbox_events")); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	outboxPrunedCounter.Add(ctx, int64(len(ids)))
+	return len(ids), nil
+}
+
+// Run は interval 毎に削除できるイベントを削除する(batchSize 件削除できた場合は待たずに続ける)
+func (p *outboxPruner) Run(ctx context.Context, interval time.Duration) {
+	for {
+		n, err := p.RunOnce(ctx)
+		if err != nil {
+			log.Printf("配信済みのイベントの削除に失敗しました。: %+v\n", err)
+		}
+		if err == nil && n == p.batchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// startOutboxRelaysFromEnv は APP_OUTBOX_SINKS にカンマ区切りで指定したシンク毎にリレーを起動する
+// APP_OUTBOX_RETENTION が0より大きければ、全てのシンクに配信済みで保持期間を過ぎたイベントも削除する
+// 返した関数でリレーを停止する
+func startOutboxRelaysFromEnv(ctx context.Context, db *dbExt, outboxRepo OutboxRepository) (func(), error) {
+	specs := outboxSinksFromEnv()
+	if len(specs) == 0 {
+		return func() {}, nil
+	}
+	interval, err := durationFromEnv("APP_OUTBOX_INTERVAL", time.Second)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	retention, err := durationFromEnv("APP_OUTBOX_RETENTION", defaultOutboxRetention)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	batchSize, err := intFromEnv("APP_OUTBOX_BATCH_SIZE", 100)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// 配信したイベント毎に outbox_deliveries の1行を同じトランザクションで作成する
+	// 削除するイベント毎にイベントの1行と配信済みの記録をシンクの数だけ削除する
+	pruneBatchSize := batchSize
+	if n := db.dialect.MaxRowsPerTransaction(); n > 0 {
+		batchSize = min(batchSize, n)
+		pruneBatchSize = max(1, min(pruneBatchSize, n/(len(specs)+1)))
+	}
+
+	relays := make([]*outboxRelay, 0, len(specs))
+	for _, spec := range specs {
+		sink, err := newOutboxSink(spec)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		relays = append(relays, &outboxRelay{
+			db:         db,
+			outboxRepo: outboxRepo,
+			sinkName:   spec,
+			sink:       sink,
+			timer:      &timerImpl{},
+			batchSize:  batchSize,
+		})
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, r := range relays {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Run(ctx, interval)
+		}()
+	}
+	if retention > 0 {
+		p := &outboxPruner{
+			db:         db,
+			outboxRepo: outboxRepo,
+			sinks:      specs,
+			timer:      &timerImpl{},
+			retention:  retention,
+			batchSize:  pruneBatchSize,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Run(ctx, interval)
+		}()
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}, nil
+}
+
+// outboxSinksFromEnv は APP_OUTBOX_SINKS のシンクを返す(空の場合はアウトボックスを使わない)
+func outboxSinksFromEnv() []string {
+	specs := make([]string, 0)
+	for _, spec := range strings.Split(os.Getenv("APP_OUTBOX_SINKS"), ",") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
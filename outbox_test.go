@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_handler_writeEvent(t *testing.T) {
+	ctx := context.Background()
+	h := newMemoryHandler()
+	store := h.db.(*memoryStore)
+	h.outboxRepo = &memoryOutboxRepository{store: store}
+	e := setupEcho(h)
+
+	owner, err := (&userSpawnScenario{}).Run(ctx, e)
+	require.NoError(t, err)
+	rec, err := doLoadTestRequest(ctx, e, owner, http.MethodPost, "/article", `{"title": "title1", "body": "body1"}`)
+	require.NoError(t, err)
+	res := &struct {
+		ArticleID string `json:"article_id"`
+	}{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), res))
+	for _, req := range []struct {
+		method, path, body string
+	}{
+		{http.MethodPatch, "/article/" + res.ArticleID, `{"title": "title2"}`},
+		{http.MethodPost, "/favorite/article/" + res.ArticleID, ``},
+		{http.MethodDelete, "/article/" + res.ArticleID, ``},
+	} {
+		rec, err := doLoadTestRequest(ctx, e, owner, req.method, req.path, req.body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	/* 失敗したリクエストのイベントは残らない */
+	rec, err = doLoadTestRequest(ctx, e, owner, http.MethodPost, "/favorite/article/"+res.ArticleID, ``)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	events, err := h.outboxRepo.ListUndelivered(ctx, "stdout", 10)
+	require.NoError(t, err)
+	types := make([]string, 0, len(events))
+	for _, event := range events {
+		require.Equal(t, res.ArticleID, event.AggregateID)
+		require.True(t, json.Valid([]byte(event.Payload)))
+		types = append(types, event.EventType)
+	}
+	require.ElementsMatch(t, []string{eventArticleCreated, eventArticleUpdated, eventArticleFavorited, eventArticleDeleted}, types)
+}
+
+type failingSink struct {
+	err error
+}
+
+func (s *failingSink) Publish(context.Context, []*OutboxEvent) error {
+	return s.err
+}
+
+func Test_outboxRelay(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	outboxRepo := &memoryOutboxRepository{store: store}
+	for i, id := range []string{"event-b", "event-a", "event-c", "event-d"} {
+		createdAt := baseTime.Add(time.Duration(i/2+1) * time.Second)
+		require.NoError(t, outboxRepo.Insert(ctx, nil, &OutboxEvent{ID: id, EventType: eventArticleCreated, AggregateID: "article-1", Payload: `{}`, CreatedAt: createdAt}))
+	}
+
+	timerMock := &timerImplMock{}
+	timerMock.On("Now").Return(baseTime.Add(12 * time.Second))
+	buf := &bytes.Buffer{}
+	r := &outboxRelay{
+		db:         store,
+		outboxRepo: outboxRepo,
+		sinkName:   "stdout",
+		sink:       &failingSink{err: errors.New("配信失敗")},
+		timer:      timerMock,
+		batchSize:  3,
+	}
+	readIDs := func() []string {
+		ids := make([]string, 0)
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			m := &outboxMessage{}
+			require.NoError(t, json.Unmarshal([]byte(line), m))
+			ids = append(ids, m.ID)
+		}
+		buf.Reset()
+		return ids
+	}
+
+	/* 配信に失敗した場合は配信済みにしない */
+	_, err := r.RunOnce(ctx)
+	require.Error(t, err)
+	events, err := outboxRepo.ListUndelivered(ctx, "stdout", 10)
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+
+	/* (created_at, id) の順に batchSize 件ずつ配信する */
+	r.sink = &writerSink{w: buf}
+	n, err := r.RunOnce(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	n, err = r.RunOnce(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	n, err = r.RunOnce(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, []string{"event-a", "event-b", "event-c", "event-d"}, readIDs())
+
+	/* 配信済みのイベントより前の created_at で後からコミットされたイベントも配信する */
+	require.NoError(t, outboxRepo.Insert(ctx, nil, &OutboxEvent{ID: "event-late", EventType: eventArticleCreated, AggregateID: "article-2", Payload: `{}`, CreatedAt: baseTime}))
+	n, err = r.RunOnce(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, []string{"event-late"}, readIDs())
+
+	/* 配信済みの記録はシンク毎 */
+	r.sinkName = "file:events.jsonl"
+	n, err = r.RunOnce(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, []string{"event-late", "event-a", "event-b"}, readIDs())
+}
+
+func Test_outboxPruner(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	outboxRepo := &memoryOutboxRepository{store: store}
+	for i, id := range []string{"event-a", "event-b", "event-c", "event-d"} {
+		require.NoError(t, outboxRepo.Insert(ctx, nil, &OutboxEvent{ID: id, EventType: eventArticleCreated, AggregateID: "article-1", Payload: `{}`, CreatedAt: baseTime.Add(time.Duration(i) * time.Minute)}))
+	}
+	// event-a, b, c は両方のシンクに、event-d は stdout だけに配信済み
+	require.NoError(t, outboxRepo.MarkDelivered(ctx, nil, "stdout", []string{"event-a", "event-b", "event-c", "event-d"}, baseTime))
+	require.NoError(t, outboxRepo.MarkDelivered(ctx, nil, "file:events.jsonl", []string{"event-a", "event-b", "event-c"}, baseTime))
+
+	timerMock := &timerImplMock{}
+	timerMock.On("Now").Return(baseTime.Add(time.Hour + 90*time.Second))
+	p := &outboxPruner{
+		db:         store,
+		outboxRepo: outboxRepo,
+		sinks:      []string{"stdout", "file:events.jsonl"},
+		timer:      timerMock,
+		retention:  time.Hour,
+		batchSize:  1,
+	}
+
+	/* 保持期間を過ぎて全てのシンクに配信済みのイベントだけを batchSize 件ずつ削除する */
+	for _, want := range []int{1, 1, 0} {
+		n, err := p.RunOnce(ctx)
+		require.NoError(t, err)
+		require.Equal(t, want, n)
+	}
+	require.Len(t, store.outbox, 2)
+	require.Contains(t, store.outbox, "event-c") // 保持期間内
+	require.Contains(t, store.outbox, "event-d") // 未配信のシンクがある
+	for key := range store.deliveries {
+		require.Contains(t, []string{"event-c", "event-d"}, key[1])
+	}
+}
+
+func Test_outboxSinks(t *testing.T) {
+	ctx := context.Background()
+	events := []*OutboxEvent{
+		{ID: "event-1", EventType: eventArticleCreated, AggregateID: "article-1", Payload: `{"id":"article-1"}`, CreatedAt: baseTime},
+	}
+
+	/* JSONLファイルには追記する */
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sink, err := newOutboxSink("file:" + path)
+	require.NoError(t, err)
+	require.NoError(t, sink.Publish(ctx, events))
+	require.NoError(t, sink.Publish(ctx, events))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	line := `{"id":"event-1","event_type":"article.created","aggregate_id":"article-1","payload":{"id":"article-1"},"created_at":"2021-01-01T00:00:00Z"}` + "\n"
+	require.Equal(t, line+line, string(b))
+
+	/* webhookは2xx以外を失敗にする */
+	status := http.StatusOK
+	var received []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	sink, err = newOutboxSink("webhook:" + srv.URL)
+	require.NoError(t, err)
+	require.NoError(t, sink.Publish(ctx, events))
+	require.JSONEq(t, `[{"id":"event-1","event_type":"article.created","aggregate_id":"article-1","payload":{"id":"article-1"},"created_at":"2021-01-01T00:00:00Z"}]`, string(received))
+	status = http.StatusInternalServerError
+	require.Error(t, sink.Publish(ctx, events))
+
+	_, err = newOutboxSink("kafka:localhost")
+	require.Error(t, err)
+}
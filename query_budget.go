@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type queryStatsKey struct{}
+
+// queryStats はリクエスト中に実行した文の数とDBの所要時間
+// BEGIN/COMMITは数えない(インメモリ実装ではリポジトリのメソッドの呼び出しを1つの文として数える)
+type queryStats struct {
+	mu       sync.Mutex
+	queries  int
+	prepares int
+	dbTime   time.Duration
+	// repeats はクエリ毎の実行回数(N+1の検出に使う)
+	repeats map[string]int
+}
+
+// withQueryStats は文を数える queryStats をコンテキストに設定する(既に設定されている場合はそれを返す)
+func withQueryStats(ctx context.Context) (context.Context, *queryStats) {
+	if s := queryStatsFromContext(ctx); s != nil {
+		return ctx, s
+	}
+	s := &queryStats{repeats: make(map[string]int)}
+	return context.WithValue(ctx, queryStatsKey{}, s), s
+}
+
+// queryStatsFromContext はコンテキストの queryStats を返す(設定されていない場合はnil)
+func queryStatsFromContext(ctx context.Context) *queryStats {
+	s, _ := ctx.Value(queryStatsKey{}).(*queryStats)
+	return s
+}
+
+// addQuery は実行した文を数える(nilの場合は何もしない)
+func (s *queryStats) addQuery(query string, duration time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries++
+	s.dbTime += duration
+	s.repeats[query]++
+}
+
+// addPrepare はステートメントの準備を数える(nilの場合は何もしない)
+func (s *queryStats) addPrepare(duration time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prepares++
+	s.dbTime += duration
+}
+
+// Queries は実行した文の数
+func (s *queryStats) Queries() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries
+}
+
+// Prepares は準備したステートメントの数
+func (s *queryStats) Prepares() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.prepares
+}
+
+// DBTime は文の実行とステートメントの準備にかかった時間の合計
+func (s *queryStats) DBTime() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dbTime
+}
+
+// MostRepeated は最も多く実行したクエリとその回数を返す
+func (s *queryStats) MostRepeated() (string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	query, count := "", 0
+	for q, n := range s.repeats {
+		if n > count || (n == count && q < query) {
+			query, count = q, n
+		}
+	}
+	return query, count
+}
+
+var (
+	requestStatementsHistogram, _ = meter.Int64Histogram(
+		"blog.http.db.statements",
+		metric.WithDescription("1リクエストで実行した文の数"),
+	)
+	requestDBTimeHistogram, _ = meter.Float64Histogram(
+		"blog.http.db.duration",
+		metric.WithDescription("1リクエストでDBにかかった時間"),
+		metric.WithUnit("s"),
+	)
+	queryBudgetExceededCounter, _ = meter.Int64Counter(
+		"blog.http.db.budget_exceeded",
+		metric.WithDescription("クエリの上限を超えたリクエスト数"),
+	)
+)
+
+// queryBudget は1リクエストで実行してよい文の数の上限
+type queryBudget struct {
+	maxStatements int // 文の数の上限(0は無制限)
+	maxRepeats    int // 同じクエリを実行してよい回数の上限(N+1の検出に使う。0は無制限)
+	// fail が true の場合は上限を超えたリクエストを500にする。false の場合は警告をログに出力するだけ
+	// 判定はトランザクションのコミット後なので、上限を超えた変更を防ぐものではない
+	// テストで文の数の増加を検出するためのアサーション用で、環境変数では指定できない
+	fail bool
+}
+
+// queryBudgetFromEnv は APP_QUERY_BUDGET_MAX_STATEMENTS か APP_QUERY_BUDGET_MAX_REPEATS が指定されていれば上限を返す(未指定の場合はnil)
+// 上限を超えたリクエストは警告をログに出力するだけで失敗させない(fail はテストでのみ設定する)
+func queryBudgetFromEnv() (*queryBudget, error) {
+	maxStatements, err := intFromEnv("APP_QUERY_BUDGET_MAX_STATEMENTS", 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	maxRepeats, err := intFromEnv("APP_QUERY_BUDGET_MAX_REPEATS", 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if maxStatements <= 0 && maxRepeats <= 0 {
+		return nil, nil
+	}
+	return &queryBudget{
+		maxStatements: maxStatements,
+		maxRepeats:    maxRepeats,
+	}, nil
+}
+
+// exceeded は上限を超えていれば理由を返す(超えていない場合は空文字)
+func (b *queryBudget) exceeded(s *queryStats) string {
+	if b == nil {
+		return ""
+	}
+	if b.maxStatements > 0 && s.Queries() > b.maxStatements {
+		return "statements"
+	}
+	if _, n := s.MostRepeated(); b.maxRepeats > 0 && n > b.maxRepeats {
+		return "repeats"
+	}
+	return ""
+}
+
+// bufferedResponseWriter は上限を超えた場合にレスポンスを差し替えられるように、レスポンスをメモリに溜める
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// countQueries はリクエスト毎に文の数、ステートメントの準備の数、DBの所要時間を数え、スパンの属性とメトリクスに記録する
+// h.queryBudget を超えた場合は警告をログに出力する(テストで fail を設定した場合はレスポンスを溜めておき、500に差し替える)
+// 上限はリクエストの処理が終わってから判定するため、上限を超えた時点でトランザクションを中断することはない
+func (h *handler) countQueries(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx, stats := withQueryStats(c.Request().Context())
+		c.SetRequest(c.Request().WithContext(ctx))
+
+		var buffered *bufferedResponseWriter
+		original := c.Response().Writer
+		if h.queryBudget != nil && h.queryBudget.fail {
+			buffered = &bufferedResponseWriter{header: original.Header().Clone(), status: http.StatusOK}
+			c.Response().Writer = buffered
+		}
+		err := next(c)
+		if buffered != nil && err != nil {
+			// エラーのレスポンスも差し替えられるように、ここでエラーハンドラーを呼び出して溜める
+			c.Error(err)
+			err = nil
+		}
+
+		route := c.Path()
+		attrs := metric.WithAttributes(
+			attribute.String("http.route", route),
+			attribute.String("http.request.method", c.Request().Method),
+		)
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.Int("db.statements", stats.Queries()),
+			attribute.Int("db.prepares", stats.Prepares()),
+			attribute.Float64("db.duration_ms", float64(stats.DBTime().Microseconds())/1000),
+		)
+		requestStatementsHistogram.Record(ctx, int64(stats.Queries()), attrs)
+		requestDBTimeHistogram.Record(ctx, stats.DBTime().Seconds(), attrs)
+
+		reason := h.queryBudget.exceeded(stats)
+		if reason != "" {
+			queryBudgetExceededCounter.Add(ctx, 1, attrs, metric.WithAttributes(attribute.String("reason", reason)))
+			query, repeats := stats.MostRepeated()
+			logger.LogAttrs(ctx, slog.LevelWarn, "クエリの上限を超えました",
+				slog.String("reason", reason),
+				slog.String("http.route", route),
+				slog.String("http.request.method", c.Request().Method),
+				slog.Int("statements", stats.Queries()),
+				slog.Int("prepares", stats.Prepares()),
+				slog.Float64("db_duration_ms", float64(stats.DBTime().Microseconds())/1000),
+				slog.String("most_repeated_query", normalizeQuery(query)),
+				slog.Int("most_repeated_count", repeats),
+			)
+		}
+		if buffered == nil {
+			return errors.WithStack(err)
+		}
+
+		res := c.Response()
+		res.Writer, res.Status, res.Size, res.Committed = original, http.StatusOK, 0, false
+		if reason != "" {
+			return echo.NewHTTPError(http.StatusInternalServerError, "クエリの上限を超えました。: "+reason)
+		}
+		for k, v := range buffered.header {
+			res.Header()[k] = v
+		}
+		res.WriteHeader(buffered.status)
+		_, err = res.Write(buffered.body.Bytes())
+		return errors.WithStack(err)
+	}
+}
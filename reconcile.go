@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"github.com/cockroachdb/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	reconcileCheckedCounter, _ = meter.Int64Counter(
+		"blog.reconcile.favorite_count.checked",
+		metric.WithDescription("お気に入り数を確認した記事数"),
+	)
+	reconcileCorrectedCounter, _ = meter.Int64Counter(
+		"blog.reconcile.favorite_count.corrected",
+		metric.WithDescription("お気に入り数を修正した記事数"),
+	)
+)
+
+// favoriteCountReconciler は articles.total_favorite_count を users_articles の件数から数え直す
+type favoriteCountReconciler struct {
+	db           transactor
+	articleRepo  ArticleRepository
+	favoriteRepo FavoriteRepository
+	timer        timer
+	batchSize    int
+	dryRun       bool // true の場合はずれを報告するだけで修正しない
+}
+
+// reconcileResult は数え直した結果
+type reconcileResult struct {
+	Checked   int
+	Drifted   int
+	Corrected int
+}
+
+// Run は記事を id 順に batchSize 件ずつ確認する
+// 一覧はトランザクション外で取得するため、ずれていた記事はトランザクション内で数え直してから修正する
+func (r *favoriteCountReconciler) Run(ctx context.Context) (*reconcileResult, error) {
+	// リーダーの遅延で誤検知しないようにライターから読む
+	ctx = withReadYourWrites(ctx)
+	attrs := metric.WithAttributes(attribute.Bool("dry_run", r.dryRun))
+
+	result := &reconcileResult{}
+	afterID := ""
+	for {
+		counts, err := r.articleRepo.ListFavoriteCounts(ctx, afterID, r.batchSize)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(counts) == 0 {
+			return result, nil
+		}
+		afterID = counts[len(counts)-1].ArticleID
+		result.Checked += len(counts)
+		reconcileCheckedCounter.Add(ctx, int64(len(counts)), attrs)
+
+		for _, count := range counts {
+			if count.Stored == count.Actual {
+				continue
+			}
+			result.Drifted++
+			log.Printf("お気に入り数がずれています。: article_id=%s stored=%d actual=%d", count.ArticleID, count.Stored, count.Actual)
+			if r.dryRun {
+				continue
+			}
+			corrected, err := r.correct(ctx, count.ArticleID)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if corrected {
+				result.Corrected++
+				reconcileCorrectedCounter.Add(ctx, 1, attrs)
+			}
+		}
+	}
+}
+
+// correct は1つの記事のお気に入り数を数え直し、ずれていれば修正する
+// 数えてから更新するまでに他のトランザクションが割り込まないようにREPEATABLE READで実行する(競合した場合はリトライされる)
+func (r *favoriteCountReconciler) correct(ctx context.Context, articleID string) (bool, error) {
+	corrected := false
+	if err := r.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+		corrected = false
+		article, err := r.articleRepo.Find(ctx, tx, articleID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				// 確認後に削除された
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		actual, err := r.favoriteRepo.CountByArticle(ctx, tx, articleID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if article.TotalFavoriteCount == actual {
+			return nil
+		}
+		corrected = true
+		return errors.WithStack(r.articleRepo.UpdateTotalFavoriteCount(ctx, tx, articleID, actual, r.timer.Now()))
+	}, withIsolationLevel(sql.LevelRepeatableRead), withTxName("reconcile_favorite_count")); err != nil {
+		return false, errors.WithStack(err)
+	}
+	return corrected, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_favoriteCountReconciler(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	articleRepo := &memoryArticleRepository{store: store}
+	favoriteRepo := &memoryFavoriteRepository{store: store}
+
+	// 記事 i は i 人がお気に入り登録していて、偶数番目の記事のお気に入り数をずらしておく
+	for i := 0; i < 5; i++ {
+		articleID := fmt.Sprintf("article-%d", i)
+		stored := i
+		if i%2 == 0 {
+			stored = i + 3
+		}
+		require.NoError(t, articleRepo.Insert(ctx, nil, &Article{ID: articleID, TotalFavoriteCount: stored, Version: 1, CreatedAt: baseTime, UpdatedAt: baseTime}))
+		for j := 0; j < i; j++ {
+			require.NoError(t, favoriteRepo.Insert(ctx, nil, &UserArticle{UserID: fmt.Sprintf("user-%d", j), ArticleID: articleID}))
+		}
+	}
+
+	now := baseTime.Add(time.Hour)
+	timerMock := &timerImplMock{}
+	timerMock.On("Now").Return(now)
+	r := &favoriteCountReconciler{
+		db:           store,
+		articleRepo:  articleRepo,
+		favoriteRepo: favoriteRepo,
+		timer:        timerMock,
+		batchSize:    2,
+		dryRun:       true,
+	}
+
+	/* dry-runは修正しない */
+	result, err := r.Run(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &reconcileResult{Checked: 5, Drifted: 3, Corrected: 0}, result)
+	article, err := articleRepo.Find(ctx, nil, "article-0")
+	require.NoError(t, err)
+	require.Equal(t, 3, article.TotalFavoriteCount)
+
+	r.dryRun = false
+	result, err = r.Run(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &reconcileResult{Checked: 5, Drifted: 3, Corrected: 3}, result)
+	for i := 0; i < 5; i++ {
+		article, err := articleRepo.Find(ctx, nil, fmt.Sprintf("article-%d", i))
+		require.NoError(t, err)
+		require.Equal(t, i, article.TotalFavoriteCount)
+		if i%2 == 0 {
+			require.Equal(t, now, article.UpdatedAt)
+			require.Equal(t, int64(1), article.Version, "お気に入り数の数え直しではバージョンを変えない")
+		}
+	}
+
+	result, err = r.Run(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &reconcileResult{Checked: 5, Drifted: 0, Corrected: 0}, result)
+}
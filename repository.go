@@ -0,0 +1,720 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// transactor はリポジトリの操作を1つのトランザクションにまとめる
+// dbExt と memoryStore が実装する
+type transactor interface {
+	Transaction(ctx context.Context, f func(ctx context.Context, tx *txExt) error, opts ...txOption) error
+}
+
+// 各リポジトリのメソッドは tx が nil の場合はトランザクション外で実行する
+// 対象の行が無い場合は sql.ErrNoRows を返す
+
+// errArticleVersionConflict は記事が読み込んだ後に更新または削除されていたことを示す
+var errArticleVersionConflict = errors.New("記事のバージョンが一致しません。")
+
+type UserRepository interface {
+	Insert(ctx context.Context, tx *txExt, user *User) error
+	FindByEmail(ctx context.Context, email string) (*User, error)
+}
+
+type ArticleRepository interface {
+	Find(ctx context.Context, tx *txExt, id string) (*Article, error)
+	// List は q.Sort の順に q.After より後の記事を q.Limit 件返す
+	List(ctx context.Context, q *articleListQuery) ([]*Article, error)
+	// ListFavoritedBy はユーザーがお気に入り登録した記事を作成日時の新しい順に返す
+	ListFavoritedBy(ctx context.Context, tx *txExt, userID string) ([]*Article, error)
+	Insert(ctx context.Context, tx *txExt, article *Article) error
+	// InsertBatch は複数の記事を複数行のINSERTで作成する
+	InsertBatch(ctx context.Context, tx *txExt, articles []*Article) error
+	// Update はタイトル、本文、更新日時を更新してバージョンを1増やす
+	// article.Version が現在のバージョンと異なる場合は errArticleVersionConflict を返す
+	Update(ctx context.Context, tx *txExt, article *Article) error
+	// AddTotalFavoriteCount はお気に入り数を delta だけ増減する(読み込まずに1文で更新するので同時に更新しても失われない)
+	// お気に入り数は編集の競合に関係しないため、バージョン(ETag)は変えない
+	AddTotalFavoriteCount(ctx context.Context, tx *txExt, id string, delta int, updatedAt time.Time) error
+	// UpdateTotalFavoriteCount はお気に入り数を count にする(バージョンは変えない)
+	UpdateTotalFavoriteCount(ctx context.Context, tx *txExt, id string, count int, updatedAt time.Time) error
+	// ListFavoriteCounts は afterID より後の記事を id 順に limit 件、保存されているお気に入り数と users_articles の件数を返す
+	ListFavoriteCounts(ctx context.Context, afterID string, limit int) ([]*favoriteCount, error)
+	// Delete は記事とシャーディングカウンターの行を削除する(お気に入りは FavoriteRepository.DeleteByArticle で先に削除する)
+	// article.Version が現在のバージョンと異なる場合は errArticleVersionConflict を返す
+	Delete(ctx context.Context, tx *txExt, article *Article) error
+}
+
+type FavoriteRepository interface {
+	Insert(ctx context.Context, tx *txExt, userArticle *UserArticle) error
+	// CountByArticle は記事をお気に入り登録しているユーザー数を返す
+	CountByArticle(ctx context.Context, tx *txExt, articleID string) (int, error)
+	// Delete はユーザーのお気に入りを削除する(登録されていなかった場合は false を返す)
+	Delete(ctx context.Context, tx *txExt, userID, articleID string) (bool, error)
+	// DeleteByArticle は記事のお気に入りを最大 limit 件削除し、削除した件数を返す(limit が0以下の場合は全て削除する)
+	DeleteByArticle(ctx context.Context, tx *txExt, articleID string, limit int) (int, error)
+}
+
+type IdempotencyRepository interface {
+	// Reserve はキーを処理中として登録する(有効期限切れの記録と、staleBefore 以前に登録されて処理中のまま残った記録は上書きする)
+	// 有効期限内の記録が既にある場合は false を返す
+	Reserve(ctx context.Context, tx *txExt, key *IdempotencyKey, staleBefore time.Time) (bool, error)
+	// Find は now の時点で有効期限内の記録を返す
+	Find(ctx context.Context, tx *txExt, scope, key string, now time.Time) (*IdempotencyKey, error)
+	// Complete は処理中の記録にレスポンスを保存する
+	Complete(ctx context.Context, tx *txExt, key *IdempotencyKey) error
+	// Release は処理中の記録を削除して、同じキーで再実行できるようにする
+	Release(ctx context.Context, tx *txExt, scope, key string) error
+	// ListExpired は now の時点で有効期限切れの記録のキーを after より後からキー順に limit 件返す
+	ListExpired(ctx context.Context, now time.Time, after orphanKey, limit int) ([]orphanKey, error)
+	// DeleteExpired はまだ有効期限切れの場合に削除し、削除したかどうかを返す
+	DeleteExpired(ctx context.Context, tx *txExt, key orphanKey, now time.Time) (bool, error)
+}
+
+type OutboxRepository interface {
+	Insert(ctx context.Context, tx *txExt, event *OutboxEvent) error
+	// ListUndelivered はシンクにまだ配信していないイベントを (created_at, id) の順に limit 件返す
+	// 位置ではなく配信済みかどうかで選ぶので、後からコミットされたトランザクションのイベントも読み飛ばさない
+	ListUndelivered(ctx context.Context, sink string, limit int) ([]*OutboxEvent, error)
+	// MarkDelivered はイベントをシンクに配信済みにする(配信済みのイベントは無視する)
+	MarkDelivered(ctx context.Context, tx *txExt, sink string, eventIDs []string, deliveredAt time.Time) error
+	// ListDelivered は before より前に作成され、sinks の全てに配信済みのイベントのIDを (created_at, id) の順に limit 件返す
+	ListDelivered(ctx context.Context, sinks []string, before time.Time, limit int) ([]string, error)
+	// DeleteEvents はイベントとその配信済みの記録を削除する
+	DeleteEvents(ctx context.Context, tx *txExt, eventIDs []string) error
+}
+
+// favoriteCount は記事に保存されているお気に入り数と users_articles から数えたお気に入り数
+type favoriteCount struct {
+	ArticleID string
+	Stored    int
+	Actual    int
+}
+
+const (
+	userColumns    = "id, name, email, password_hash, created_at, updated_at"
+	articleColumns = "id, title, body, user_id, total_favorite_count, version, created_at, updated_at"
+)
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{}
+	if err := row.Scan(&user.ID, &user.Name, &user.Email, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return user, nil
+}
+
+func scanArticle(row rowScanner) (*Article, error) {
+	article := &Article{}
+	if err := row.Scan(&article.ID, &article.Title, &article.Body, &article.UserID, &article.TotalFavoriteCount, &article.Version, &article.CreatedAt, &article.UpdatedAt); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return article, nil
+}
+
+func scanArticles(rows *sql.Rows) ([]*Article, error) {
+	defer rows.Close()
+	articles := make([]*Article, 0)
+	for rows.Next() {
+		article, err := scanArticle(rows)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		articles = append(articles, article)
+	}
+	return articles, errors.WithStack(rows.Err())
+}
+
+// execInTx はステートメントを準備して実行する
+func execInTx(ctx context.Context, tx *txExt, query string, args ...any) (sql.Result, error) {
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer stmt.Close()
+	result, err := stmt.ExecContext(ctx, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+type sqlUserRepository struct {
+	db *dbExt
+}
+
+func (r *sqlUserRepository) Insert(ctx context.Context, tx *txExt, user *User) error {
+	_, err := execInTx(ctx, tx, "INSERT INTO users ("+userColumns+") VALUES ($1, $2, $3, $4, $5, $6)",
+		user.ID, user.Name, user.Email, user.PasswordHash, user.CreatedAt, user.UpdatedAt)
+	return errors.WithStack(err)
+}
+
+func (r *sqlUserRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+	user, err := scanUser(r.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE email = $1", email))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return user, nil
+}
+
+type sqlArticleRepository struct {
+	db *dbExt
+	// counterShards が1以上の場合はお気に入り数を article_favorite_counters の counterShards 行に分散して加算する
+	// 同じ記事へのお気に入り登録が同じ行の更新で競合しないようにするため
+	counterShards int
+}
+
+// favoriteCounterShardsFromEnvPrefix は <prefix>APP_FAVORITE_COUNTER_SHARDS のシャーディングカウンターの行数を返す(未指定は0で使わない)
+func favoriteCounterShardsFromEnvPrefix(prefix string) (int, error) {
+	v := prefixedGetenv(prefix)("APP_FAVORITE_COUNTER_SHARDS")
+	if v == "" {
+		return 0, nil
+	}
+	shards, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if shards < 0 {
+		return 0, errors.Newf("APP_FAVORITE_COUNTER_SHARDS は0以上で指定してください。: %d", shards)
+	}
+	return shards, nil
+}
+
+// selectColumns は articleColumns と同じ順のSELECT句を返す
+// シャーディングカウンターを使う場合のお気に入り数は articles.total_favorite_count とカウンターの合計
+func (r *sqlArticleRepository) selectColumns() string {
+	if r.counterShards <= 0 {
+		return articleColumns
+	}
+	return "id, title, body, user_id, " + favoriteCountExpr + ", version, created_at, updated_at"
+}
+
+const favoriteCountExpr = "(total_favorite_count + COALESCE((SELECT sum(c.count) FROM article_favorite_counters c WHERE c.article_id = articles.id), 0))::bigint"
+
+func (r *sqlArticleRepository) Find(ctx context.Context, tx *txExt, id string) (*Article, error) {
+	query := "SELECT " + r.selectColumns() + " FROM articles WHERE id = $1"
+	var row *sql.Row
+	if tx == nil {
+		row = r.db.QueryRowContext(ctx, query, id)
+	} else {
+		row = tx.QueryRowContext(ctx, query, id)
+	}
+	article, err := scanArticle(row)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return article, nil
+}
+
+// keysetCondition はキーセットページネーションで (first, second) が ($i, $j) より op 側の行の条件を返す
+// DSQLでも使えるように行値の比較 (first, second) > ($i, $j) は使わず、キーセットの条件は全てこの OR の形で書く
+func keysetCondition(first, second, op string, i, j int) string {
+	return fmt.Sprintf("(%[1]s %[3]s $%[4]d OR (%[1]s = $%[4]d AND %[2]s %[3]s $%[5]d))", first, second, op, i, j)
+}
+
+// List はキーセットページネーションで (並び順の値, id) が q.After より後の記事を返す
+func (r *sqlArticleRepository) List(ctx context.Context, q *articleListQuery) ([]*Article, error) {
+	column, desc := "created_at", true
+	switch q.Sort {
+	case articleSortOldest:
+		desc = false
+	case articleSortFavorites:
+		column = "total_favorite_count"
+		if r.counterShards > 0 {
+			column = favoriteCountExpr
+		}
+	}
+	op, order := "<", "DESC"
+	if !desc {
+		op, order = ">", "ASC"
+	}
+
+	query := "SELECT " + r.selectColumns() + " FROM articles"
+	args := make([]any, 0, 3)
+	if q.After != nil {
+		var value any = q.After.CreatedAt
+		if q.Sort == articleSortFavorites {
+			value = q.After.FavoriteCount
+		}
+		query += " WHERE " + keysetCondition(column, "id", op, 1, 2)
+		args = append(args, value, q.After.ID)
+	}
+	query += fmt.Sprintf(" ORDER BY %[1]s %[2]s, id %[2]s LIMIT $%[3]d", column, order, len(args)+1)
+	args = append(args, q.Limit)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return scanArticles(rows)
+}
+
+func (r *sqlArticleRepository) ListFavoritedBy(ctx context.Context, tx *txExt, userID string) ([]*Article, error) {
+	query := "SELECT " + r.selectColumns() + " FROM articles WHERE id IN (SELECT article_id FROM users_articles WHERE user_id = $1) ORDER BY created_at DESC"
+	var rows *sql.Rows
+	var err error
+	if tx == nil {
+		rows, err = r.db.QueryContext(ctx, query, userID)
+	} else {
+		rows, err = tx.QueryContext(ctx, query, userID)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return scanArticles(rows)
+}
+
+func (r *sqlArticleRepository) Insert(ctx context.Context, tx *txExt, article *Article) error {
+	_, err := execInTx(ctx, tx, "INSERT INTO articles ("+articleColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		article.ID, article.Title, article.Body, article.UserID, article.TotalFavoriteCount, article.Version, article.CreatedAt, article.UpdatedAt)
+	return errors.WithStack(err)
+}
+
+// articleInsertChunkSize は1つのINSERT文で作成する記事の数(バインド変数の数の上限65535を超えないようにする)
+const articleInsertChunkSize = 500
+
+func (r *sqlArticleRepository) InsertBatch(ctx context.Context, tx *txExt, articles []*Article) error {
+	for start := 0; start < len(articles); start += articleInsertChunkSize {
+		chunk := articles[start:min(start+articleInsertChunkSize, len(articles))]
+		values := make([]string, 0, len(chunk))
+		args := make([]any, 0, len(chunk)*8)
+		for _, article := range chunk {
+			n := len(args)
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8))
+			args = append(args, article.ID, article.Title, article.Body, article.UserID, article.TotalFavoriteCount, article.Version, article.CreatedAt, article.UpdatedAt)
+		}
+		// 件数によってSQL文が変わるため、ステートメントキャッシュは使わない
+		if _, err := tx.ExecContext(ctx, "INSERT INTO articles ("+articleColumns+") VALUES "+strings.Join(values, ", "), args...); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (r *sqlArticleRepository) Update(ctx context.Context, tx *txExt, article *Article) error {
+	result, err := execInTx(ctx, tx, "UPDATE articles SET title = $1, body = $2, updated_at = $3, version = version + 1 WHERE id = $4 AND version = $5",
+		article.Title, article.Body, article.UpdatedAt, article.ID, article.Version)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := checkVersionMatched(result); err != nil {
+		return errors.WithStack(err)
+	}
+	article.Version++
+	return nil
+}
+
+// AddTotalFavoriteCount はシャーディングカウンターを使う場合はランダムに選んだカウンターの行に加算する
+// どちらの場合も記事のバージョンは変わらない
+func (r *sqlArticleRepository) AddTotalFavoriteCount(ctx context.Context, tx *txExt, id string, delta int, updatedAt time.Time) error {
+	if r.counterShards > 0 {
+		_, err := execInTx(ctx, tx, `INSERT INTO article_favorite_counters (article_id, shard, count, updated_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT (article_id, shard) DO UPDATE SET count = article_favorite_counters.count + EXCLUDED.count, updated_at = EXCLUDED.updated_at`,
+			id, rand.IntN(r.counterShards), delta, updatedAt)
+		return errors.WithStack(err)
+	}
+	_, err := execInTx(ctx, tx, "UPDATE articles SET total_favorite_count = total_favorite_count + $1, updated_at = $2 WHERE id = $3",
+		delta, updatedAt, id)
+	return errors.WithStack(err)
+}
+
+// UpdateTotalFavoriteCount はシャーディングカウンターの行を削除して articles に集約する
+// シャーディングカウンターを使わない設定に切り替えた後も、数え直せば残ったカウンターが二重に数えられることはない
+func (r *sqlArticleRepository) UpdateTotalFavoriteCount(ctx context.Context, tx *txExt, id string, count int, updatedAt time.Time) error {
+	if _, err := execInTx(ctx, tx, "DELETE FROM article_favorite_counters WHERE article_id = $1", id); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err := execInTx(ctx, tx, "UPDATE articles SET total_favorite_count = $1, updated_at = $2 WHERE id = $3",
+		count, updatedAt, id)
+	return errors.WithStack(err)
+}
+
+func (r *sqlArticleRepository) ListFavoriteCounts(ctx context.Context, afterID string, limit int) ([]*favoriteCount, error) {
+	stored := "total_favorite_count"
+	if r.counterShards > 0 {
+		stored = favoriteCountExpr
+	}
+	rows, err := r.db.QueryContext(ctx, "SELECT id, "+stored+`, (SELECT count(*) FROM users_articles ua WHERE ua.article_id = articles.id)
+FROM articles WHERE id > $1 ORDER BY id LIMIT $2`, afterID, limit)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	counts := make([]*favoriteCount, 0, limit)
+	for rows.Next() {
+		count := &favoriteCount{}
+		if err := rows.Scan(&count.ArticleID, &count.Stored, &count.Actual); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		counts = append(counts, count)
+	}
+	return counts, errors.WithStack(rows.Err())
+}
+
+func (r *sqlArticleRepository) Delete(ctx context.Context, tx *txExt, article *Article) error {
+	if _, err := execInTx(ctx, tx, "DELETE FROM article_favorite_counters WHERE article_id = $1", article.ID); err != nil {
+		return errors.WithStack(err)
+	}
+	result, err := execInTx(ctx, tx, "DELETE FROM articles WHERE id = $1 AND version = $2", article.ID, article.Version)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(checkVersionMatched(result))
+}
+
+// checkVersionMatched はバージョンを条件にした更新で対象の行が無かった場合に errArticleVersionConflict を返す
+func checkVersionMatched(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if n == 0 {
+		return errors.WithStack(errArticleVersionConflict)
+	}
+	return nil
+}
+
+type sqlFavoriteRepository struct {
+	db *dbExt
+}
+
+func (r *sqlFavoriteRepository) Insert(ctx context.Context, tx *txExt, userArticle *UserArticle) error {
+	_, err := execInTx(ctx, tx, "INSERT INTO users_articles (user_id, article_id, created_at, updated_at) VALUES ($1, $2, $3, $4)",
+		userArticle.UserID, userArticle.ArticleID, userArticle.CreatedAt, userArticle.UpdatedAt)
+	return errors.WithStack(err)
+}
+
+func (r *sqlFavoriteRepository) CountByArticle(ctx context.Context, tx *txExt, articleID string) (int, error) {
+	query := "SELECT count(*) FROM users_articles WHERE article_id = $1"
+	var row *sql.Row
+	if tx == nil {
+		row = r.db.QueryRowContext(ctx, query, articleID)
+	} else {
+		row = tx.QueryRowContext(ctx, query, articleID)
+	}
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return count, nil
+}
+
+func (r *sqlFavoriteRepository) Delete(ctx context.Context, tx *txExt, userID, articleID string) (bool, error) {
+	result, err := execInTx(ctx, tx, "DELETE FROM users_articles WHERE user_id = $1 AND article_id = $2", userID, articleID)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n > 0, nil
+}
+
+func (r *sqlFavoriteRepository) DeleteByArticle(ctx context.Context, tx *txExt, articleID string, limit int) (int, error) {
+	query, args := "DELETE FROM users_articles WHERE article_id = $1", []any{articleID}
+	if limit > 0 {
+		query, args = `DELETE FROM users_articles
+WHERE article_id = $1 AND user_id IN (SELECT user_id FROM users_articles WHERE article_id = $1 LIMIT $2)`, []any{articleID, limit}
+	}
+	result, err := execInTx(ctx, tx, query, args...)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return int(n), nil
+}
+
+// orphanKind は親の行が無くなって孤立した行の種類
+// 外部キーの無いバックエンド(DSQL)では、アプリケーション外での削除や削除処理の不具合で孤立した行が残ることがある
+type orphanKind string
+
+const (
+	orphanArticles         orphanKind = "articles"                  // 著者のユーザーが無い記事
+	orphanFavoritesArticle orphanKind = "users_articles.article_id" // 記事が無いお気に入り
+	orphanFavoritesUser    orphanKind = "users_articles.user_id"    // ユーザーが無いお気に入り
+	orphanFavoriteCounters orphanKind = "article_favorite_counters" // 記事が無いシャーディングカウンター
+)
+
+// orphanKinds は孤立した行を探す順番
+// 記事のお気に入りは件数に上限が無いため記事と同じトランザクションでは削除せず、記事の後に孤立したお気に入りとして削除する
+var orphanKinds = []orphanKind{orphanArticles, orphanFavoritesArticle, orphanFavoritesUser, orphanFavoriteCounters}
+
+// orphanKey は孤立した行のキー(お気に入りは user_id, article_id、それ以外は1つ目のみ使う)
+type orphanKey [2]string
+
+type OrphanRepository interface {
+	// ListOrphans は after より後の孤立した行のキーをキー順に limit 件返す
+	ListOrphans(ctx context.Context, kind orphanKind, after orphanKey, limit int) ([]orphanKey, error)
+	// DeleteOrphan はまだ孤立している場合に削除し、削除したかどうかを返す
+	DeleteOrphan(ctx context.Context, tx *txExt, kind orphanKind, key orphanKey) (bool, error)
+}
+
+type sqlOrphanRepository struct {
+	db *dbExt
+}
+
+func (r *sqlOrphanRepository) ListOrphans(ctx context.Context, kind orphanKind, after orphanKey, limit int) ([]orphanKey, error) {
+	var rows *sql.Rows
+	var err error
+	switch kind {
+	case orphanArticles:
+		rows, err = r.db.QueryContext(ctx, `SELECT a.id, '' FROM articles a
+WHERE a.id > $1 AND NOT EXISTS (SELECT 1 FROM users u WHERE u.id = a.user_id) ORDER BY a.id LIMIT $2`, after[0], limit)
+	case orphanFavoritesArticle:
+		rows, err = r.db.QueryContext(ctx, `SELECT ua.user_id, ua.article_id FROM users_articles ua
+WHERE `+keysetCondition("ua.user_id", "ua.article_id", ">", 1, 2)+` AND NOT EXISTS (SELECT 1 FROM articles a WHERE a.id = ua.article_id)
+ORDER BY ua.user_id, ua.article_id LIMIT $3`, after[0], after[1], limit)
+	case orphanFavoritesUser:
+		rows, err = r.db.QueryContext(ctx, `SELECT ua.user_id, ua.article_id FROM users_articles ua
+WHERE `+keysetCondition("ua.user_id", "ua.article_id", ">", 1, 2)+` AND NOT EXISTS (SELECT 1 FROM users u WHERE u.id = ua.user_id)
+ORDER BY ua.user_id, ua.article_id LIMIT $3`, after[0], after[1], limit)
+	case orphanFavoriteCounters:
+		rows, err = r.db.QueryContext(ctx, `SELECT DISTINCT c.article_id, '' FROM article_favorite_counters c
+WHERE c.article_id > $1 AND NOT EXISTS (SELECT 1 FROM articles a WHERE a.id = c.article_id) ORDER BY c.article_id LIMIT $2`, after[0], limit)
+	default:
+		return nil, errors.Newf("未対応の孤立した行の種類です。: %s", kind)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	keys := make([]orphanKey, 0, limit)
+	for rows.Next() {
+		var key orphanKey
+		if err := rows.Scan(&key[0], &key[1]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, errors.WithStack(rows.Err())
+}
+
+func (r *sqlOrphanRepository) DeleteOrphan(ctx context.Context, tx *txExt, kind orphanKind, key orphanKey) (bool, error) {
+	var result sql.Result
+	var err error
+	switch kind {
+	case orphanArticles:
+		var orphan bool
+		if err := tx.QueryRowContext(ctx, "SELECT NOT EXISTS (SELECT 1 FROM users u WHERE u.id = a.user_id) FROM articles a WHERE a.id = $1", key[0]).Scan(&orphan); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return false, nil
+			}
+			return false, errors.WithStack(err)
+		}
+		if !orphan {
+			return false, nil
+		}
+		// シャーディングカウンターの行はシャード数までなので同じトランザクションで削除する
+		if _, err := execInTx(ctx, tx, "DELETE FROM article_favorite_counters WHERE article_id = $1", key[0]); err != nil {
+			return false, errors.WithStack(err)
+		}
+		result, err = execInTx(ctx, tx, "DELETE FROM articles WHERE id = $1", key[0])
+	case orphanFavoritesArticle:
+		result, err = execInTx(ctx, tx, `DELETE FROM users_articles ua
+WHERE ua.user_id = $1 AND ua.article_id = $2 AND NOT EXISTS (SELECT 1 FROM articles a WHERE a.id = ua.article_id)`, key[0], key[1])
+	case orphanFavoritesUser:
+		result, err = execInTx(ctx, tx, `DELETE FROM users_articles ua
+WHERE ua.user_id = $1 AND ua.article_id = $2 AND NOT EXISTS (SELECT 1 FROM users u WHERE u.id = ua.user_id)`, key[0], key[1])
+	case orphanFavoriteCounters:
+		result, err = execInTx(ctx, tx, `DELETE FROM article_favorite_counters c
+WHERE c.article_id = $1 AND NOT EXISTS (SELECT 1 FROM articles a WHERE a.id = c.article_id)`, key[0])
+	default:
+		return false, errors.Newf("未対応の孤立した行の種類です。: %s", kind)
+	}
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n > 0, nil
+}
+
+const idempotencyKeyColumns = "scope, idempotency_key, request_hash, status, content_type, body, created_at, expires_at"
+
+type sqlIdempotencyRepository struct {
+	db *dbExt
+}
+
+func (r *sqlIdempotencyRepository) Reserve(ctx context.Context, tx *txExt, key *IdempotencyKey, staleBefore time.Time) (bool, error) {
+	result, err := execInTx(ctx, tx, "INSERT INTO idempotency_keys ("+idempotencyKeyColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (scope, idempotency_key) DO UPDATE
+SET request_hash = EXCLUDED.request_hash, status = EXCLUDED.status, content_type = EXCLUDED.content_type, body = EXCLUDED.body,
+    created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at
+WHERE idempotency_keys.expires_at <= EXCLUDED.created_at OR (idempotency_keys.status = 0 AND idempotency_keys.created_at <= $9)`,
+		key.Scope, key.Key, key.RequestHash, key.Status, key.ContentType, key.Body, key.CreatedAt, key.ExpiresAt, staleBefore)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n > 0, nil
+}
+
+func (r *sqlIdempotencyRepository) Find(ctx context.Context, tx *txExt, scope, key string, now time.Time) (*IdempotencyKey, error) {
+	k := &IdempotencyKey{}
+	if err := tx.QueryRowContext(ctx, "SELECT "+idempotencyKeyColumns+" FROM idempotency_keys WHERE scope = $1 AND idempotency_key = $2 AND expires_at > $3",
+		scope, key, now).Scan(&k.Scope, &k.Key, &k.RequestHash, &k.Status, &k.ContentType, &k.Body, &k.CreatedAt, &k.ExpiresAt); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return k, nil
+}
+
+func (r *sqlIdempotencyRepository) Complete(ctx context.Context, tx *txExt, key *IdempotencyKey) error {
+	_, err := execInTx(ctx, tx, "UPDATE idempotency_keys SET status = $1, content_type = $2, body = $3 WHERE scope = $4 AND idempotency_key = $5 AND request_hash = $6",
+		key.Status, key.ContentType, key.Body, key.Scope, key.Key, key.RequestHash)
+	return errors.WithStack(err)
+}
+
+func (r *sqlIdempotencyRepository) Release(ctx context.Context, tx *txExt, scope, key string) error {
+	_, err := execInTx(ctx, tx, "DELETE FROM idempotency_keys WHERE scope = $1 AND idempotency_key = $2 AND status = 0", scope, key)
+	return errors.WithStack(err)
+}
+
+func (r *sqlIdempotencyRepository) ListExpired(ctx context.Context, now time.Time, after orphanKey, limit int) ([]orphanKey, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT scope, idempotency_key FROM idempotency_keys
+WHERE `+keysetCondition("scope", "idempotency_key", ">", 1, 2)+` AND expires_at <= $3 ORDER BY scope, idempotency_key LIMIT $4`, after[0], after[1], now, limit)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	keys := make([]orphanKey, 0, limit)
+	for rows.Next() {
+		var key orphanKey
+		if err := rows.Scan(&key[0], &key[1]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, errors.WithStack(rows.Err())
+}
+
+func (r *sqlIdempotencyRepository) DeleteExpired(ctx context.Context, tx *txExt, key orphanKey, now time.Time) (bool, error) {
+	result, err := execInTx(ctx, tx, "DELETE FROM idempotency_keys WHERE scope = $1 AND idempotency_key = $2 AND expires_at <= $3", key[0], key[1], now)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n > 0, nil
+}
+
+const outboxEventColumns = "id, event_type, aggregate_id, payload, created_at"
+
+type sqlOutboxRepository struct {
+	db *dbExt
+}
+
+func (r *sqlOutboxRepository) Insert(ctx context.Context, tx *txExt, event *OutboxEvent) error {
+	_, err := execInTx(ctx, tx, "INSERT INTO outbox_events ("+outboxEventColumns+") VALUES ($1, $2, $3, $4, $5)",
+		event.ID, event.EventType, event.AggregateID, event.Payload, event.CreatedAt)
+	return errors.WithStack(err)
+}
+
+func (r *sqlOutboxRepository) ListUndelivered(ctx context.Context, sink string, limit int) ([]*OutboxEvent, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+outboxEventColumns+` FROM outbox_events AS e
+WHERE NOT EXISTS (SELECT 1 FROM outbox_deliveries AS d WHERE d.event_id = e.id AND d.sink = $1)
+ORDER BY created_at, id LIMIT $2`, sink, limit)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	events := make([]*OutboxEvent, 0, limit)
+	for rows.Next() {
+		event := &OutboxEvent{}
+		if err := rows.Scan(&event.ID, &event.EventType, &event.AggregateID, &event.Payload, &event.CreatedAt); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		events = append(events, event)
+	}
+	return events, errors.WithStack(rows.Err())
+}
+
+func (r *sqlOutboxRepository) MarkDelivered(ctx context.Context, tx *txExt, sink string, eventIDs []string, deliveredAt time.Time) error {
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	values := make([]string, 0, len(eventIDs))
+	args := []any{sink, deliveredAt}
+	for _, id := range eventIDs {
+		args = append(args, id)
+		values = append(values, fmt.Sprintf("($1, $%d, $2)", len(args)))
+	}
+	// 件数によってSQL文が変わるため、ステートメントキャッシュは使わない
+	_, err := tx.ExecContext(ctx, "INSERT INTO outbox_deliveries (sink, event_id, delivered_at) VALUES "+strings.Join(values, ", ")+
+		" ON CONFLICT (event_id, sink) DO NOTHING", args...)
+	return errors.WithStack(err)
+}
+
+// placeholders は $start から n 個のプレースホルダーをカンマ区切りで返す
+func placeholders(start, n int) string {
+	ps := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		ps = append(ps, fmt.Sprintf("$%d", start+i))
+	}
+	return strings.Join(ps, ", ")
+}
+
+func (r *sqlOutboxRepository) ListDelivered(ctx context.Context, sinks []string, before time.Time, limit int) ([]string, error) {
+	if len(sinks) == 0 {
+		return []string{}, nil
+	}
+	args := []any{before, len(sinks), limit}
+	for _, sink := range sinks {
+		args = append(args, sink)
+	}
+	rows, err := r.db.QueryContext(ctx, `SELECT e.id FROM outbox_events AS e
+WHERE e.created_at < $1 AND (SELECT COUNT(*) FROM outbox_deliveries AS d WHERE d.event_id = e.id AND d.sink IN (`+placeholders(4, len(sinks))+`)) = $2
+ORDER BY e.created_at, e.id LIMIT $3`, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	ids := make([]string, 0, limit)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, errors.WithStack(rows.Err())
+}
+
+func (r *sqlOutboxRepository) DeleteEvents(ctx context.Context, tx *txExt, eventIDs []string) error {
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	args := make([]any, 0, len(eventIDs))
+	for _, id := range eventIDs {
+		args = append(args, id)
+	}
+	// 件数によってSQL文が変わるため、ステートメントキャッシュは使わない
+	in := placeholders(1, len(eventIDs))
+	if _, err := tx.ExecContext(ctx, "DELETE FROM outbox_deliveries WHERE event_id IN ("+in+")", args...); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err := tx.ExecContext(ctx, "DELETE FROM outbox_events WHERE id IN ("+in+")", args...)
+	return errors.WithStack(err)
+}
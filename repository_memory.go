@@ -0,0 +1,599 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math/rand/v2"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/lib/pq"
+)
+
+// memoryStore はリポジトリのインメモリ実装が共有するデータ
+// Postgresなしでハンドラーをテストするために使う
+// トランザクションはストア全体のロックで直列化し、エラー時は開始時点のスナップショットに戻す
+type memoryStore struct {
+	mu            sync.Mutex
+	users         map[string]User
+	articles      map[string]Article
+	usersArticles map[[2]string]UserArticle
+	counters      map[memoryCounterKey]int
+	idempotency   map[[2]string]IdempotencyKey
+	outbox        map[string]OutboxEvent
+	deliveries    map[[2]string]time.Time // (シンク, イベントのID) と配信日時
+}
+
+type memoryCounterKey struct {
+	articleID string
+	shard     int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:         make(map[string]User),
+		articles:      make(map[string]Article),
+		usersArticles: make(map[[2]string]UserArticle),
+		counters:      make(map[memoryCounterKey]int),
+		idempotency:   make(map[[2]string]IdempotencyKey),
+		outbox:        make(map[string]OutboxEvent),
+		deliveries:    make(map[[2]string]time.Time),
+	}
+}
+
+type memoryTxKey struct{}
+
+// lock はトランザクション外であればストアをロックする(トランザクション中は既にロック済み)
+// リポジトリのメソッドの呼び出しを1つの文としてリクエストの文の数に加える(呼び出し元のメソッド名をクエリとして数える)
+func (s *memoryStore) lock(ctx context.Context) func() {
+	if stats := queryStatsFromContext(ctx); stats != nil {
+		name := ""
+		if pc, _, _, ok := runtime.Caller(1); ok {
+			name = runtime.FuncForPC(pc).Name()
+		}
+		stats.addQuery(name, 0)
+	}
+	if ctx.Value(memoryTxKey{}) == s {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+func (s *memoryStore) Transaction(ctx context.Context, f func(ctx context.Context, tx *txExt) error, _ ...txOption) error {
+	tx := &txExt{snapshot: s.snapshot}
+	if err := s.transaction(ctx, func(ctx context.Context) error {
+		return errors.WithStack(f(ctx, tx))
+	}); err != nil {
+		return errors.WithStack(err)
+	}
+	// コミット後の処理はロックを解放してから実行する
+	tx.runAfterCommit(ctx)
+	return nil
+}
+
+func (s *memoryStore) transaction(ctx context.Context, f func(ctx context.Context) error) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	restore := s.snapshot()
+	defer func() {
+		if p := recover(); p != nil {
+			restore()
+			panic(p)
+		}
+		if err != nil {
+			restore()
+		}
+	}()
+
+	ctx = context.WithValue(ctx, memoryTxKey{}, s)
+	if err := f(ctx); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// snapshot は現在のデータを複製し、その時点に戻す関数を返す(ロックした状態で呼び出す)
+func (s *memoryStore) snapshot() func() {
+	users, articles, usersArticles, counters := cloneMap(s.users), cloneMap(s.articles), cloneMap(s.usersArticles), cloneMap(s.counters)
+	idempotency, outbox, deliveries := cloneMap(s.idempotency), cloneMap(s.outbox), cloneMap(s.deliveries)
+	return func() {
+		s.users, s.articles, s.usersArticles, s.counters = users, articles, usersArticles, counters
+		s.idempotency, s.outbox, s.deliveries = idempotency, outbox, deliveries
+	}
+}
+
+func cloneMap[K comparable, V any](m map[K]V) map[K]V {
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// uniqueViolation はPostgresの一意制約違反と同じエラーを返す
+func uniqueViolation(constraint string) error {
+	return errors.WithStack(&pq.Error{
+		Code:       "23505",
+		Message:    "duplicate key value violates unique constraint \"" + constraint + "\"",
+		Constraint: constraint,
+	})
+}
+
+func sortByCreatedAtDesc(articles []*Article) {
+	sort.SliceStable(articles, func(i, j int) bool {
+		return articles[i].CreatedAt.After(articles[j].CreatedAt)
+	})
+}
+
+type memoryUserRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryUserRepository) Insert(ctx context.Context, _ *txExt, user *User) error {
+	defer r.store.lock(ctx)()
+	if _, ok := r.store.users[user.ID]; ok {
+		return uniqueViolation("users_pkey")
+	}
+	for _, u := range r.store.users {
+		if u.Email == user.Email {
+			return uniqueViolation("users_email_key")
+		}
+	}
+	r.store.users[user.ID] = *user
+	return nil
+}
+
+func (r *memoryUserRepository) FindByEmail(ctx context.Context, email string) (*User, error) {
+	defer r.store.lock(ctx)()
+	for _, u := range r.store.users {
+		if u.Email == email {
+			return &u, nil
+		}
+	}
+	return nil, errors.WithStack(sql.ErrNoRows)
+}
+
+type memoryArticleRepository struct {
+	store         *memoryStore
+	counterShards int
+}
+
+// withCounters はシャーディングカウンターを合計したお気に入り数の記事を返す
+func (r *memoryArticleRepository) withCounters(a Article) *Article {
+	for key, count := range r.store.counters {
+		if key.articleID == a.ID {
+			a.TotalFavoriteCount += count
+		}
+	}
+	return &a
+}
+
+func (r *memoryArticleRepository) Find(ctx context.Context, _ *txExt, id string) (*Article, error) {
+	defer r.store.lock(ctx)()
+	article, ok := r.store.articles[id]
+	if !ok {
+		return nil, errors.WithStack(sql.ErrNoRows)
+	}
+	return r.withCounters(article), nil
+}
+
+func (r *memoryArticleRepository) List(ctx context.Context, q *articleListQuery) ([]*Article, error) {
+	defer r.store.lock(ctx)()
+	articles := make([]*Article, 0, len(r.store.articles))
+	for _, a := range r.store.articles {
+		article := r.withCounters(a)
+		if q.After != nil && !q.less(q.After, newArticleCursor(q.Sort, article)) {
+			continue
+		}
+		articles = append(articles, article)
+	}
+	sort.Slice(articles, func(i, j int) bool {
+		return q.less(newArticleCursor(q.Sort, articles[i]), newArticleCursor(q.Sort, articles[j]))
+	})
+	if len(articles) > q.Limit {
+		articles = articles[:q.Limit]
+	}
+	return articles, nil
+}
+
+func (r *memoryArticleRepository) ListFavoritedBy(ctx context.Context, _ *txExt, userID string) ([]*Article, error) {
+	defer r.store.lock(ctx)()
+	articles := make([]*Article, 0)
+	for key := range r.store.usersArticles {
+		if key[0] != userID {
+			continue
+		}
+		if a, ok := r.store.articles[key[1]]; ok {
+			articles = append(articles, r.withCounters(a))
+		}
+	}
+	sortByCreatedAtDesc(articles)
+	return articles, nil
+}
+
+func (r *memoryArticleRepository) Insert(ctx context.Context, _ *txExt, article *Article) error {
+	defer r.store.lock(ctx)()
+	if _, ok := r.store.articles[article.ID]; ok {
+		return uniqueViolation("articles_pkey")
+	}
+	r.store.articles[article.ID] = *article
+	return nil
+}
+
+func (r *memoryArticleRepository) InsertBatch(ctx context.Context, _ *txExt, articles []*Article) error {
+	defer r.store.lock(ctx)()
+	for _, article := range articles {
+		if _, ok := r.store.articles[article.ID]; ok {
+			return uniqueViolation("articles_pkey")
+		}
+		r.store.articles[article.ID] = *article
+	}
+	return nil
+}
+
+func (r *memoryArticleRepository) Update(ctx context.Context, _ *txExt, article *Article) error {
+	defer r.store.lock(ctx)()
+	a, ok := r.store.articles[article.ID]
+	if !ok || a.Version != article.Version {
+		return errors.WithStack(errArticleVersionConflict)
+	}
+	a.Title, a.Body, a.UpdatedAt = article.Title, article.Body, article.UpdatedAt
+	a.Version++
+	r.store.articles[article.ID] = a
+	article.Version = a.Version
+	return nil
+}
+
+func (r *memoryArticleRepository) UpdateTotalFavoriteCount(ctx context.Context, _ *txExt, id string, count int, updatedAt time.Time) error {
+	defer r.store.lock(ctx)()
+	a, ok := r.store.articles[id]
+	if !ok {
+		return nil
+	}
+	r.store.deleteCounters(id)
+	a.TotalFavoriteCount, a.UpdatedAt = count, updatedAt
+	r.store.articles[id] = a
+	return nil
+}
+
+func (r *memoryArticleRepository) AddTotalFavoriteCount(ctx context.Context, _ *txExt, id string, delta int, updatedAt time.Time) error {
+	defer r.store.lock(ctx)()
+	a, ok := r.store.articles[id]
+	if !ok {
+		return nil
+	}
+	if r.counterShards > 0 {
+		r.store.counters[memoryCounterKey{articleID: id, shard: rand.IntN(r.counterShards)}] += delta
+		return nil
+	}
+	a.TotalFavoriteCount += delta
+	a.UpdatedAt = updatedAt
+	r.store.articles[id] = a
+	return nil
+}
+
+func (r *memoryArticleRepository) ListFavoriteCounts(ctx context.Context, afterID string, limit int) ([]*favoriteCount, error) {
+	defer r.store.lock(ctx)()
+	counts := make([]*favoriteCount, 0)
+	for id, a := range r.store.articles {
+		if id > afterID {
+			counts = append(counts, &favoriteCount{ArticleID: id, Stored: r.withCounters(a).TotalFavoriteCount, Actual: r.store.countFavorites(id)})
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].ArticleID < counts[j].ArticleID })
+	if len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts, nil
+}
+
+func (r *memoryArticleRepository) Delete(ctx context.Context, _ *txExt, article *Article) error {
+	defer r.store.lock(ctx)()
+	a, ok := r.store.articles[article.ID]
+	if !ok || a.Version != article.Version {
+		return errors.WithStack(errArticleVersionConflict)
+	}
+	r.store.deleteCounters(article.ID)
+	delete(r.store.articles, article.ID)
+	return nil
+}
+
+type memoryFavoriteRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryFavoriteRepository) Insert(ctx context.Context, _ *txExt, userArticle *UserArticle) error {
+	defer r.store.lock(ctx)()
+	key := [2]string{userArticle.UserID, userArticle.ArticleID}
+	if _, ok := r.store.usersArticles[key]; ok {
+		return uniqueViolation("users_articles_pkey")
+	}
+	r.store.usersArticles[key] = *userArticle
+	return nil
+}
+
+func (r *memoryFavoriteRepository) CountByArticle(ctx context.Context, _ *txExt, articleID string) (int, error) {
+	defer r.store.lock(ctx)()
+	return r.store.countFavorites(articleID), nil
+}
+
+func (s *memoryStore) countFavorites(articleID string) int {
+	count := 0
+	for key := range s.usersArticles {
+		if key[1] == articleID {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *memoryFavoriteRepository) Delete(ctx context.Context, _ *txExt, userID, articleID string) (bool, error) {
+	defer r.store.lock(ctx)()
+	key := [2]string{userID, articleID}
+	if _, ok := r.store.usersArticles[key]; !ok {
+		return false, nil
+	}
+	delete(r.store.usersArticles, key)
+	return true, nil
+}
+
+func (r *memoryFavoriteRepository) DeleteByArticle(ctx context.Context, _ *txExt, articleID string, limit int) (int, error) {
+	defer r.store.lock(ctx)()
+	deleted := 0
+	for key := range r.store.usersArticles {
+		if limit > 0 && deleted >= limit {
+			break
+		}
+		if key[1] == articleID {
+			delete(r.store.usersArticles, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *memoryStore) deleteCounters(articleID string) {
+	for key := range s.counters {
+		if key.articleID == articleID {
+			delete(s.counters, key)
+		}
+	}
+}
+
+type memoryOrphanRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryOrphanRepository) ListOrphans(ctx context.Context, kind orphanKind, after orphanKey, limit int) ([]orphanKey, error) {
+	defer r.store.lock(ctx)()
+	keys := make([]orphanKey, 0)
+	seen := make(map[orphanKey]bool)
+	for _, key := range r.store.orphans(kind) {
+		if !seen[key] && (key[0] > after[0] || key[0] == after[0] && key[1] > after[1]) {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
+
+func (r *memoryOrphanRepository) DeleteOrphan(ctx context.Context, _ *txExt, kind orphanKind, key orphanKey) (bool, error) {
+	defer r.store.lock(ctx)()
+	for _, orphan := range r.store.orphans(kind) {
+		if orphan != key {
+			continue
+		}
+		switch kind {
+		case orphanArticles:
+			r.store.deleteCounters(key[0])
+			delete(r.store.articles, key[0])
+		case orphanFavoritesArticle, orphanFavoritesUser:
+			delete(r.store.usersArticles, [2]string(key))
+		case orphanFavoriteCounters:
+			r.store.deleteCounters(key[0])
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// orphans は kind の孤立した行のキーを返す(重複することがある)
+func (s *memoryStore) orphans(kind orphanKind) []orphanKey {
+	keys := make([]orphanKey, 0)
+	switch kind {
+	case orphanArticles:
+		for id, a := range s.articles {
+			if _, ok := s.users[a.UserID]; !ok {
+				keys = append(keys, orphanKey{id, ""})
+			}
+		}
+	case orphanFavoritesArticle:
+		for key := range s.usersArticles {
+			if _, ok := s.articles[key[1]]; !ok {
+				keys = append(keys, orphanKey(key))
+			}
+		}
+	case orphanFavoritesUser:
+		for key := range s.usersArticles {
+			if _, ok := s.users[key[0]]; !ok {
+				keys = append(keys, orphanKey(key))
+			}
+		}
+	case orphanFavoriteCounters:
+		for key := range s.counters {
+			if _, ok := s.articles[key.articleID]; !ok {
+				keys = append(keys, orphanKey{key.articleID, ""})
+			}
+		}
+	}
+	return keys
+}
+
+type memoryIdempotencyRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryIdempotencyRepository) Reserve(ctx context.Context, _ *txExt, key *IdempotencyKey, staleBefore time.Time) (bool, error) {
+	defer r.store.lock(ctx)()
+	k := [2]string{key.Scope, key.Key}
+	if existing, ok := r.store.idempotency[k]; ok && existing.ExpiresAt.After(key.CreatedAt) &&
+		(existing.Status != 0 || existing.CreatedAt.After(staleBefore)) {
+		return false, nil
+	}
+	r.store.idempotency[k] = *key
+	return true, nil
+}
+
+func (r *memoryIdempotencyRepository) Find(ctx context.Context, _ *txExt, scope, key string, now time.Time) (*IdempotencyKey, error) {
+	defer r.store.lock(ctx)()
+	k, ok := r.store.idempotency[[2]string{scope, key}]
+	if !ok || !k.ExpiresAt.After(now) {
+		return nil, errors.WithStack(sql.ErrNoRows)
+	}
+	return &k, nil
+}
+
+func (r *memoryIdempotencyRepository) Complete(ctx context.Context, _ *txExt, key *IdempotencyKey) error {
+	defer r.store.lock(ctx)()
+	k := [2]string{key.Scope, key.Key}
+	if existing, ok := r.store.idempotency[k]; ok && existing.RequestHash == key.RequestHash {
+		existing.Status, existing.ContentType, existing.Body = key.Status, key.ContentType, key.Body
+		r.store.idempotency[k] = existing
+	}
+	return nil
+}
+
+func (r *memoryIdempotencyRepository) Release(ctx context.Context, _ *txExt, scope, key string) error {
+	defer r.store.lock(ctx)()
+	k := [2]string{scope, key}
+	if existing, ok := r.store.idempotency[k]; ok && existing.Status == 0 {
+		delete(r.store.idempotency, k)
+	}
+	return nil
+}
+
+func (r *memoryIdempotencyRepository) ListExpired(ctx context.Context, now time.Time, after orphanKey, limit int) ([]orphanKey, error) {
+	defer r.store.lock(ctx)()
+	keys := make([]orphanKey, 0)
+	for k, v := range r.store.idempotency {
+		key := orphanKey(k)
+		if !v.ExpiresAt.After(now) && (key[0] > after[0] || key[0] == after[0] && key[1] > after[1]) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
+
+func (r *memoryIdempotencyRepository) DeleteExpired(ctx context.Context, _ *txExt, key orphanKey, now time.Time) (bool, error) {
+	defer r.store.lock(ctx)()
+	k := [2]string(key)
+	if existing, ok := r.store.idempotency[k]; ok && !existing.ExpiresAt.After(now) {
+		delete(r.store.idempotency, k)
+		return true, nil
+	}
+	return false, nil
+}
+
+type memoryOutboxRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryOutboxRepository) Insert(ctx context.Context, _ *txExt, event *OutboxEvent) error {
+	defer r.store.lock(ctx)()
+	if _, ok := r.store.outbox[event.ID]; ok {
+		return uniqueViolation("outbox_events_pkey")
+	}
+	r.store.outbox[event.ID] = *event
+	return nil
+}
+
+func (r *memoryOutboxRepository) ListUndelivered(ctx context.Context, sink string, limit int) ([]*OutboxEvent, error) {
+	defer r.store.lock(ctx)()
+	events := make([]*OutboxEvent, 0)
+	for _, e := range r.store.outbox {
+		if _, ok := r.store.deliveries[[2]string{sink, e.ID}]; !ok {
+			events = append(events, &e)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].CreatedAt.Equal(events[j].CreatedAt) {
+			return events[i].CreatedAt.Before(events[j].CreatedAt)
+		}
+		return events[i].ID < events[j].ID
+	})
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (r *memoryOutboxRepository) MarkDelivered(ctx context.Context, _ *txExt, sink string, eventIDs []string, deliveredAt time.Time) error {
+	defer r.store.lock(ctx)()
+	for _, id := range eventIDs {
+		if _, ok := r.store.deliveries[[2]string{sink, id}]; !ok {
+			r.store.deliveries[[2]string{sink, id}] = deliveredAt
+		}
+	}
+	return nil
+}
+
+func (r *memoryOutboxRepository) ListDelivered(ctx context.Context, sinks []string, before time.Time, limit int) ([]string, error) {
+	defer r.store.lock(ctx)()
+	events := make([]*OutboxEvent, 0)
+	for _, e := range r.store.outbox {
+		if !e.CreatedAt.Before(before) || len(sinks) == 0 {
+			continue
+		}
+		delivered := true
+		for _, sink := range sinks {
+			if _, ok := r.store.deliveries[[2]string{sink, e.ID}]; !ok {
+				delivered = false
+				break
+			}
+		}
+		if delivered {
+			events = append(events, &e)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].CreatedAt.Equal(events[j].CreatedAt) {
+			return events[i].CreatedAt.Before(events[j].CreatedAt)
+		}
+		return events[i].ID < events[j].ID
+	})
+	ids := make([]string, 0, min(len(events), limit))
+	for _, e := range events[:min(len(events), limit)] {
+		ids = append(ids, e.ID)
+	}
+	return ids, nil
+}
+
+func (r *memoryOutboxRepository) DeleteEvents(ctx context.Context, _ *txExt, eventIDs []string) error {
+	defer r.store.lock(ctx)()
+	for _, id := range eventIDs {
+		delete(r.store.outbox, id)
+		for key := range r.store.deliveries {
+			if key[1] == id {
+				delete(r.store.deliveries, key)
+			}
+		}
+	}
+	return nil
+}
@@ -4,13 +4,19 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand/v2"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/errors"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 )
 
@@ -19,57 +25,185 @@ func sleep() {
 }
 
 func doLoadTestRequest(ctx context.Context, e *echo.Echo, userName, method, path, body string) (*httptest.ResponseRecorder, error) {
-	req, err := http.NewRequestWithContext(ctx, method, path, strings.NewReader(body))
+	return doLoadTestRequestWithHeader(ctx, e, userName, method, path, body, nil)
+}
+
+func doLoadTestRequestWithHeader(ctx context.Context, e *echo.Echo, userName, method, path, body string, header http.Header) (*httptest.ResponseRecorder, error) {
+	retry := loadTestClientRetryFromContext(ctx)
+	if retry != nil && retry.idempotencyKeys && method == http.MethodPost && header.Get(headerIdempotencyKey) == "" {
+		header = header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set(headerIdempotencyKey, uuid.NewString())
+	}
+	send := func() (*httptest.ResponseRecorder, error) {
+		req, err := http.NewRequestWithContext(ctx, method, path, strings.NewReader(body))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.SetBasicAuth(userName+"@email.com", userName)
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		e.ServeHTTP(rec, req)
+		if stats := loadTestStatsFromContext(ctx); stats != nil {
+			stats.record(endpointName(e, req), time.Since(start), rec.Code)
+		}
+		return rec, nil
+	}
+
+	rec, err := send()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if retry == nil || header.Get(headerIdempotencyKey) == "" || !retry.hit() {
+		return rec, nil
+	}
+	// タイムアウトしたクライアントが同じIdempotency-Keyで再送した場合に、最初と同じレスポンスが返ることを確認する
+	retried, err := send()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
-	req.SetBasicAuth(userName+"@email.com", userName)
-	rec := httptest.NewRecorder()
-	e.ServeHTTP(rec, req)
-	return rec, nil
+	if rec.Code < http.StatusInternalServerError && (retried.Code != rec.Code || retried.Body.String() != rec.Body.String()) {
+		return nil, errors.Newf("再送したリクエストのレスポンスが異なります。: %s %s %d %s -> %d %s",
+			method, path, rec.Code, rec.Body.String(), retried.Code, retried.Body.String())
+	}
+	return retried, nil
+}
+
+// loadTestClientRetry は負荷試験のクライアントがPOSTに付けるIdempotency-Keyと再送の設定
+type loadTestClientRetry struct {
+	idempotencyKeys bool // POSTに毎回新しいIdempotency-Keyを付ける
+	retryRate       int  // 同じIdempotency-Keyで再送する確率(%)
+}
+
+// loadTestClientRetryFromEnv は APP_IDEMPOTENCY_KEYS と APP_CLIENT_RETRY_RATE から再送の設定を返す(どちらも未指定の場合はnil)
+func loadTestClientRetryFromEnv() (*loadTestClientRetry, error) {
+	retryRate, err := intFromEnv("APP_CLIENT_RETRY_RATE", 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if retryRate < 0 || retryRate > 100 {
+		return nil, errors.Newf("APP_CLIENT_RETRY_RATE は0〜100で指定してください。: %d", retryRate)
+	}
+	if os.Getenv("APP_IDEMPOTENCY_KEYS") != "true" && retryRate == 0 {
+		return nil, nil
+	}
+	// 再送するにはIdempotency-Keyが必要
+	return &loadTestClientRetry{idempotencyKeys: true, retryRate: retryRate}, nil
+}
+
+func (r *loadTestClientRetry) hit() bool {
+	return rand.IntN(100) < r.retryRate
+}
+
+type loadTestClientRetryKey struct{}
+
+func withLoadTestClientRetry(ctx context.Context, retry *loadTestClientRetry) context.Context {
+	return context.WithValue(ctx, loadTestClientRetryKey{}, retry)
+}
+
+func loadTestClientRetryFromContext(ctx context.Context) *loadTestClientRetry {
+	retry, _ := ctx.Value(loadTestClientRetryKey{}).(*loadTestClientRetry)
+	return retry
 }
 
 type initScenario struct{}
 
+// Run は1人のユーザーで記事を POST /articles/batch でまとめて作成する
 func (s *initScenario) Run(ctx context.Context, e *echo.Echo) ([]string, error) {
 	length := 10
-	articleIDs := make([]string, 0, length)
-
-	for i := 0; i < length; i++ {
-		userName := strconv.FormatInt(time.Now().UnixNano(), 10)
+	userName := strconv.FormatInt(time.Now().UnixNano(), 10)
 
-		rec, err := doLoadTestRequest(ctx, e, userName, http.MethodPost, "/user", fmt.Sprintf(`{
+	rec, err := doLoadTestRequest(ctx, e, userName, http.MethodPost, "/user", fmt.Sprintf(`{
 		"name": "%s",
 		"email": "%s@email.com",
 		"password": "%s"
 }`, userName, userName, userName))
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		if rec.Code != http.StatusOK {
-			return nil, errors.Newf("ユーザー登録に失敗しました。: %s", rec.Body.String())
-		}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if rec.Code != http.StatusOK {
+		return nil, errors.Newf("ユーザー登録に失敗しました。: %s", rec.Body.String())
+	}
 
-		rec, err = doLoadTestRequest(ctx, e, userName, http.MethodPost, "/article", fmt.Sprintf(`{
-	"title": "title_v1 %d by %s",
-	"body": "body_v1 %d by %s"
-}`, i, userName, i, userName))
+	type article struct {
+		Title string `json:"title"`
+		Body  string `json:"body"`
+	}
+	req := &struct {
+		Articles []*article `json:"articles"`
+	}{Articles: make([]*article, 0, length)}
+	for i := 0; i < length; i++ {
+		req.Articles = append(req.Articles, &article{
+			Title: fmt.Sprintf("title_v1 %d by %s", i, userName),
+			Body:  fmt.Sprintf("body_v1 %d by %s", i, userName),
+		})
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	rec, err = doLoadTestRequest(ctx, e, userName, http.MethodPost, "/articles/batch", string(body))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if rec.Code != http.StatusOK {
+		return nil, errors.Newf("記事の一括投稿に失敗しました。: %s", rec.Body.String())
+	}
+	res := &struct {
+		Results []*struct {
+			ArticleID string `json:"article_id"`
+		} `json:"results"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	articleIDs := make([]string, 0, len(res.Results))
+	for _, r := range res.Results {
+		articleIDs = append(articleIDs, r.ArticleID)
+	}
+
+	return articleIDs, nil
+}
+
+// pageArticles は GET /articles を next_cursor を辿って最大 maxPages ページ取得し、取得した記事のIDを返す
+func pageArticles(ctx context.Context, e *echo.Echo, userName string, order articleSort, limit, maxPages int) ([]string, error) {
+	articleIDs := make([]string, 0)
+	cursor := ""
+	for page := 0; page < maxPages; page++ {
+		query := url.Values{"sort": {string(order)}, "limit": {strconv.Itoa(limit)}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		rec, err := doLoadTestRequest(ctx, e, userName, http.MethodGet, "/articles?"+query.Encode(), ``)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
 		if rec.Code != http.StatusOK {
-			return nil, errors.Newf("記事投稿に失敗しました。: %s", rec.Body.String())
+			return nil, errors.Newf("記事一覧取得に失敗しました。: %s", rec.Body.String())
 		}
 		res := &struct {
-			ArticleID string `json:"article_id"`
+			List []*struct {
+				ArticleID string `json:"article_id"`
+			} `json:"list"`
+			NextCursor string `json:"next_cursor"`
 		}{}
 		if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
 			return nil, errors.WithStack(err)
 		}
-		articleIDs = append(articleIDs, res.ArticleID)
+		for _, item := range res.List {
+			articleIDs = append(articleIDs, item.ArticleID)
+		}
+		if res.NextCursor == "" {
+			break
+		}
+		cursor = res.NextCursor
 	}
-
 	return articleIDs, nil
 }
 
@@ -95,9 +229,27 @@ func (s *userSpawnScenario) Run(ctx context.Context, e *echo.Echo) (string, erro
 
 type articleScenario struct {
 	randUtil randUtil
+	// conflictingEdits が true の場合は同じETagで同時に記事を更新するシナリオも実行する
+	conflictingEdits bool
+	// hotFavorites が true の場合は全てのユーザーが最初に同じ記事をお気に入り登録する
+	hotFavorites bool
 }
 
 func (s *articleScenario) Run(ctx context.Context, e *echo.Echo, userName string, initArticleIDs []string) error {
+	/* 人気記事のお気に入り登録 */
+	if s.hotFavorites {
+		rec, err := doLoadTestRequest(ctx, e, userName, http.MethodPost, "/favorite/article/"+initArticleIDs[0], ``)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if rec.Code != http.StatusOK {
+			return errors.Newf("お気に入り登録に失敗しました。: %s", rec.Body.String())
+		}
+		// 以降のお気に入り登録では重複しないようにする
+		initArticleIDs = initArticleIDs[1:]
+		sleep()
+	}
+
 	for i := 0; i < 5; i++ {
 		if !s.randUtil.Hit(90, 100) {
 			continue
@@ -123,12 +275,14 @@ func (s *articleScenario) Run(ctx context.Context, e *echo.Echo, userName string
 
 		/* 記事一覧取得 */
 		if s.randUtil.Hit(50, 100) {
-			rec, err = doLoadTestRequest(ctx, e, userName, http.MethodGet, "/articles", ``)
-			if err != nil {
-				return errors.WithStack(err)
+			order := articleSortNewest
+			if s.randUtil.Hit(30, 100) {
+				order = articleSortFavorites
+			} else if s.randUtil.Hit(30, 100) {
+				order = articleSortOldest
 			}
-			if rec.Code != http.StatusOK {
-				return errors.Newf("記事一覧取得に失敗しました。: %s", rec.Body.String())
+			if _, err := pageArticles(ctx, e, userName, order, 20, 3); err != nil {
+				return errors.WithStack(err)
 			}
 			sleep()
 		}
@@ -160,6 +314,14 @@ func (s *articleScenario) Run(ctx context.Context, e *echo.Echo, userName string
 			sleep()
 		}
 
+		/* 競合する記事更新 */
+		if s.conflictingEdits && s.randUtil.Hit(20, 100) {
+			if err := s.runConflictingEdits(ctx, e, userName, articleID, i); err != nil {
+				return errors.WithStack(err)
+			}
+			sleep()
+		}
+
 		/* 記事削除 */
 		if s.randUtil.Hit(1, 100) {
 			rec, err = doLoadTestRequest(ctx, e, userName, http.MethodDelete, "/article/"+articleID, ``)
@@ -200,7 +362,71 @@ func (s *articleScenario) Run(ctx context.Context, e *echo.Echo, userName string
 			}
 			sleep()
 		}
+
+		/* お気に入りの重複登録(設定により409か200) */
+		if len(initArticleIDs) > 0 && s.randUtil.Hit(10, 100) {
+			rec, err := doLoadTestRequest(ctx, e, userName, http.MethodPost, "/favorite/article/"+initArticleIDs[0], ``)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if rec.Code != http.StatusOK && rec.Code != http.StatusConflict {
+				return errors.Newf("お気に入りの重複登録に失敗しました。: %s", rec.Body.String())
+			}
+			sleep()
+		}
+
+		/* お気に入り解除 */
+		if len(initArticleIDs) > 0 && s.randUtil.Hit(30, 100) {
+			rec, err := doLoadTestRequest(ctx, e, userName, http.MethodDelete, "/favorite/article/"+initArticleIDs[0], ``)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if rec.Code != http.StatusOK {
+				return errors.Newf("お気に入り解除に失敗しました。: %s", rec.Body.String())
+			}
+			sleep()
+		}
+	}
+
+	return nil
+}
+
+// runConflictingEdits は取得したETagをIf-Matchに指定して2つの更新を同時に送り、片方だけが成功して他方が412になることを確認する
+func (s *articleScenario) runConflictingEdits(ctx context.Context, e *echo.Echo, userName, articleID string, i int) error {
+	rec, err := doLoadTestRequestWithHeader(ctx, e, userName, http.MethodGet, "/article/"+articleID, ``,
+		http.Header{headerReadYourWrites: []string{"true"}})
+	if err != nil {
+		return errors.WithStack(err)
 	}
+	if rec.Code != http.StatusOK {
+		return errors.Newf("記事詳細取得に失敗しました。: %s", rec.Body.String())
+	}
+	header := http.Header{headerIfMatch: []string{rec.Header().Get(headerETag)}}
 
+	codes := make([]int, 2)
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for j := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec, err := doLoadTestRequestWithHeader(ctx, e, userName, http.MethodPatch, "/article/"+articleID, fmt.Sprintf(`{
+	"title": "title_v3-%d %d by %s"
+}`, j, i, userName), header)
+			if err != nil {
+				errs[j] = errors.WithStack(err)
+				return
+			}
+			codes[j] = rec.Code
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return errors.WithStack(err)
+	}
+	sort.Ints(codes)
+	if codes[0] != http.StatusOK || codes[1] != http.StatusPreconditionFailed {
+		return errors.Newf("競合する記事更新の結果が不正です。: %v", codes)
+	}
 	return nil
 }
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	sweeperFoundCounter, _ = meter.Int64Counter(
+		"blog.sweeper.orphans.found",
+		metric.WithDescription("見つかった孤立した行の数"),
+	)
+	sweeperDeletedCounter, _ = meter.Int64Counter(
+		"blog.sweeper.orphans.deleted",
+		metric.WithDescription("削除した孤立した行の数"),
+	)
+)
+
+// orphanSweeper は外部キーの無いバックエンドで親の行が無くなった行を削除する
+type orphanSweeper struct {
+	db         transactor
+	orphanRepo OrphanRepository
+	// batchSize は1つのトランザクションで削除する孤立した行の数
+	// 記事はシャーディングカウンターの行も削除するため、1トランザクションの行数は最大で batchSize×(シャード数+1)になる
+	batchSize int
+
+	maxBatches int  // 1回の実行で種類毎に処理するバッチ数の上限(0は無制限)
+	dryRun     bool // true の場合は報告するだけで削除しない
+	// idempotencyRepo を指定した場合は有効期限切れのIdempotency-Keyも削除する
+	idempotencyRepo IdempotencyRepository
+	timer           timer
+}
+
+// sweepExpiredIdempotencyKeys は有効期限切れのIdempotency-Key(孤立した行ではないが、同じように不要になった行として削除する)
+const sweepExpiredIdempotencyKeys orphanKind = "idempotency_keys.expired"
+
+// sweepResult は種類毎に孤立した行を探した結果
+type sweepResult struct {
+	Kind    orphanKind
+	Found   int
+	Deleted int
+}
+
+// Run は orphanKinds の順に孤立した行をキー順に batchSize 件ずつ探して削除する
+func (s *orphanSweeper) Run(ctx context.Context) ([]*sweepResult, error) {
+	// リーダーの遅延で作成直後の行を孤立したと誤検知しないようにライターから読む(削除時にも孤立しているか確認する)
+	ctx = withReadYourWrites(ctx)
+
+	results := make([]*sweepResult, 0, len(orphanKinds)+1)
+	for _, kind := range orphanKinds {
+		result, err := s.sweep(ctx, kind,
+			func(after orphanKey) ([]orphanKey, error) {
+				return s.orphanRepo.ListOrphans(ctx, kind, after, s.batchSize)
+			},
+			func(ctx context.Context, tx *txExt, key orphanKey) (bool, error) {
+				return s.orphanRepo.DeleteOrphan(ctx, tx, kind, key)
+			},
+		)
+		if err != nil {
+			return nil, errors.Wrapf(err, "kind=%s", kind)
+		}
+		results = append(results, result)
+	}
+	if s.idempotencyRepo != nil {
+		now := s.timer.Now()
+		result, err := s.sweep(ctx, sweepExpiredIdempotencyKeys,
+			func(after orphanKey) ([]orphanKey, error) {
+				return s.idempotencyRepo.ListExpired(ctx, now, after, s.batchSize)
+			},
+			func(ctx context.Context, tx *txExt, key orphanKey) (bool, error) {
+				return s.idempotencyRepo.DeleteExpired(ctx, tx, key, now)
+			},
+		)
+		if err != nil {
+			return nil, errors.Wrapf(err, "kind=%s", sweepExpiredIdempotencyKeys)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// sweep は list で見つけた行を batchSize 件ずつ1つのトランザクションで del する
+func (s *orphanSweeper) sweep(
+	ctx context.Context,
+	kind orphanKind,
+	list func(after orphanKey) ([]orphanKey, error),
+	del func(ctx context.Context, tx *txExt, key orphanKey) (bool, error),
+) (*sweepResult, error) {
+	attrs := metric.WithAttributes(attribute.String("kind", string(kind)), attribute.Bool("dry_run", s.dryRun))
+	result := &sweepResult{Kind: kind}
+	after := orphanKey{}
+	for batch := 0; s.maxBatches <= 0 || batch < s.maxBatches; batch++ {
+		keys, err := list(after)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		after = keys[len(keys)-1]
+		result.Found += len(keys)
+		sweeperFoundCounter.Add(ctx, int64(len(keys)), attrs)
+		if s.dryRun {
+			for _, key := range keys {
+				log.Printf("孤立した行が見つかりました。: kind=%s key=%v", kind, key)
+			}
+			continue
+		}
+
+		deleted := 0
+		if err := s.db.Transaction(ctx, func(ctx context.Context, tx *txExt) error {
+			deleted = 0
+			for _, key := range keys {
+				ok, err := del(ctx, tx, key)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				if ok {
+					deleted++
+				}
+			}
+			return nil
+		}, withTxName("sweep_orphans")); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result.Deleted += deleted
+		sweeperDeletedCounter.Add(ctx, int64(deleted), attrs)
+	}
+	return result, nil
+}
+
+// RunEvery は interval 毎に Run を実行する(エラーはログに出力して次の実行を待つ)
+func (s *orphanSweeper) RunEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		results, err := s.Run(ctx)
+		if err != nil {
+			log.Printf("孤立した行の削除に失敗しました。: %+v\n", err)
+			continue
+		}
+		logSweepResults(results)
+	}
+}
+
+func logSweepResults(results []*sweepResult) {
+	for _, result := range results {
+		log.Printf("孤立した行を削除しました。: kind=%s found=%d deleted=%d", result.Kind, result.Found, result.Deleted)
+	}
+}
+
+// startSweeperFromEnv は APP_SWEEPER_INTERVAL が指定されていれば、サーバーとは別の接続でバックグラウンドに孤立した行を削除する
+// 1回の実行で削除する量は APP_SWEEPER_BATCH_SIZE と APP_SWEEPER_MAX_BATCHES で制限する
+func startSweeperFromEnv(ctx context.Context) (func(), error) {
+	v := os.Getenv("APP_SWEEPER_INTERVAL")
+	if v == "" {
+		return func() {}, nil
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	batchSize, err := intFromEnv("APP_SWEEPER_BATCH_SIZE", 100)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	maxBatches, err := intFromEnv("APP_SWEEPER_MAX_BATCHES", 10)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	counterShards, err := favoriteCounterShardsFromEnvPrefix("")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	conf := dbConfigFromEnv()
+	conf.Role = dbRoleSweeper
+	db, err := newDBExt(conf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// DSQLの1トランザクションあたりの行数の上限を超えないようにする
+	if n := db.dialect.MaxRowsPerTransaction(); n > 0 {
+		batchSize = max(1, min(batchSize, n/(counterShards+1)))
+	}
+	s := &orphanSweeper{
+		db:              db,
+		orphanRepo:      &sqlOrphanRepository{db: db},
+		batchSize:       batchSize,
+		maxBatches:      maxBatches,
+		idempotencyRepo: &sqlIdempotencyRepository{db: db},
+		timer:           &timerImpl{},
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.RunEvery(ctx, interval)
+	}()
+	return func() {
+		cancel()
+		<-done
+		db.Close()
+	}, nil
+}
+
+// durationFromEnv は key の環境変数を時間として読み込む(未指定の場合は def)
+func durationFromEnv(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s", key)
+	}
+	return d, nil
+}
+
+// intFromEnv は key の環境変数を整数として読み込む(未指定の場合は def)
+func intFromEnv(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s", key)
+	}
+	return n, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_orphanSweeper(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	store.users["user-0"] = User{ID: "user-0"}
+	// article-0 は著者がいて、article-1〜3 は著者が削除されている
+	for i := 0; i < 4; i++ {
+		userID := "user-0"
+		if i > 0 {
+			userID = "deleted-user"
+		}
+		articleID := fmt.Sprintf("article-%d", i)
+		store.articles[articleID] = Article{ID: articleID, UserID: userID}
+		store.usersArticles[[2]string{"user-0", articleID}] = UserArticle{UserID: "user-0", ArticleID: articleID}
+	}
+	// 記事もユーザーも無いお気に入りとカウンター
+	store.usersArticles[[2]string{"user-0", "deleted-article"}] = UserArticle{UserID: "user-0", ArticleID: "deleted-article"}
+	store.usersArticles[[2]string{"deleted-user", "article-0"}] = UserArticle{UserID: "deleted-user", ArticleID: "article-0"}
+	store.counters[memoryCounterKey{articleID: "article-1", shard: 0}] = 1
+	store.counters[memoryCounterKey{articleID: "deleted-article", shard: 0}] = 1
+	store.counters[memoryCounterKey{articleID: "deleted-article", shard: 1}] = 1
+
+	s := &orphanSweeper{
+		db:         store,
+		orphanRepo: &memoryOrphanRepository{store: store},
+		batchSize:  2,
+		dryRun:     true,
+	}
+
+	/* dry-runは削除しない(記事を削除していないので、その子の行は孤立していない) */
+	results, err := s.Run(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []*sweepResult{
+		{Kind: orphanArticles, Found: 3},
+		{Kind: orphanFavoritesArticle, Found: 1},
+		{Kind: orphanFavoritesUser, Found: 1},
+		{Kind: orphanFavoriteCounters, Found: 1},
+	}, results)
+	require.Len(t, store.articles, 4)
+	require.Len(t, store.usersArticles, 6)
+	require.Len(t, store.counters, 3)
+
+	/* バッチ数の上限まで削除する */
+	s.dryRun = false
+	s.maxBatches = 1
+	results, err = s.Run(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &sweepResult{Kind: orphanArticles, Found: 2, Deleted: 2}, results[0])
+	require.Len(t, store.articles, 2)
+
+	/* 残りを削除する(削除した記事のお気に入りは、記事の後に孤立したお気に入りとして削除する) */
+	s.maxBatches = 0
+	results, err = s.Run(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []*sweepResult{
+		{Kind: orphanArticles, Found: 1, Deleted: 1},
+		{Kind: orphanFavoritesArticle, Found: 2, Deleted: 2},
+		{Kind: orphanFavoritesUser, Found: 0, Deleted: 0},
+		{Kind: orphanFavoriteCounters, Found: 0, Deleted: 0},
+	}, results)
+	require.Equal(t, map[string]Article{"article-0": {ID: "article-0", UserID: "user-0"}}, store.articles)
+	require.Equal(t, map[[2]string]UserArticle{
+		{"user-0", "article-0"}: {UserID: "user-0", ArticleID: "article-0"},
+	}, store.usersArticles)
+	require.Empty(t, store.counters)
+
+	/* 孤立していない行は削除しない */
+	deleted, err := s.orphanRepo.DeleteOrphan(ctx, nil, orphanArticles, orphanKey{"article-0", ""})
+	require.NoError(t, err)
+	require.False(t, deleted)
+}
+
+func Test_orphanSweeper_expiredIdempotencyKeys(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		store.idempotency[[2]string{"user-0", key}] = IdempotencyKey{Scope: "user-0", Key: key, ExpiresAt: baseTime.Add(time.Duration(i-1) * time.Hour)}
+	}
+	timerMock := &timerImplMock{}
+	timerMock.On("Now").Return(baseTime)
+	s := &orphanSweeper{
+		db:              store,
+		orphanRepo:      &memoryOrphanRepository{store: store},
+		batchSize:       10,
+		idempotencyRepo: &memoryIdempotencyRepository{store: store},
+		timer:           timerMock,
+	}
+
+	/* 有効期限(baseTime)を過ぎたキーだけ削除する */
+	results, err := s.Run(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &sweepResult{Kind: sweepExpiredIdempotencyKeys, Found: 2, Deleted: 2}, results[len(results)-1])
+	require.Len(t, store.idempotency, 1)
+	require.Contains(t, store.idempotency, [2]string{"user-0", "key-2"})
+}